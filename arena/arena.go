@@ -0,0 +1,365 @@
+package arena
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/webbmaffian/go-mad/internal/flock"
+	"github.com/webbmaffian/go-mad/internal/utils"
+)
+
+const defaultCapacity = 4096
+
+// Files are locked while open - exclusively when opened for writing, otherwise
+// shared. Opening a file that is locked by another process fails with
+// ErrLocked.
+const ErrLocked = flock.ErrLocked
+
+// Initialize a new memory-mapped arena of variable-length blobs with a
+// filepath and an initial capacity in bytes. The arena doubles in size
+// whenever it's full.
+func New(filepath string, capacity ...int) (a *Arena, err error) {
+	a = &Arena{
+		head: newHeader(defaultCapacity),
+	}
+
+	if capacity != nil && capacity[0] > 0 {
+		a.head.capacity = uint64(capacity[0])
+	}
+
+	defer flock.CloseOnError(&err, &a.file, &a.data)
+
+	var created bool
+	info, err := os.Stat(filepath)
+
+	if err == nil {
+		if a.file, err = os.OpenFile(filepath, os.O_RDWR, 0); err != nil {
+			return
+		}
+
+		if err = flock.Lock(a.file, true); err != nil {
+			return
+		}
+
+		if err = a.validateHead(info.Size()); err != nil {
+			return
+		}
+
+		if err = a.trim(info.Size()); err != nil {
+			return
+		}
+	} else if os.IsNotExist(err) {
+		if a.file, err = os.Create(filepath); err != nil {
+			return
+		}
+
+		if err = flock.Lock(a.file, true); err != nil {
+			return
+		}
+
+		if err = a.file.Truncate(int64(a.head.fileSize())); err != nil {
+			return
+		}
+
+		created = true
+	} else {
+		return
+	}
+
+	if a.data, err = mmap.Map(a.file, mmap.RDWR, 0); err != nil {
+		return
+	}
+
+	if created {
+		if s := int(a.head.headSize); copy(a.data[:s], utils.PointerToBytes(a.head, s)) != s {
+			return nil, errors.New("failed to write header")
+		}
+
+		if err = a.Flush(); err != nil {
+			return
+		}
+	}
+
+	a.head = utils.BytesToPointer[header](a.data[:a.head.headSize])
+
+	return
+}
+
+func OpenRO(filepath string) (a *Arena, err error) {
+	a = &Arena{
+		head:     newHeader(0),
+		readonly: true,
+	}
+
+	defer flock.CloseOnError(&err, &a.file, &a.data)
+
+	info, err := os.Stat(filepath)
+
+	if err != nil {
+		return
+	}
+
+	if a.file, err = os.OpenFile(filepath, os.O_RDONLY, 0); err != nil {
+		return
+	}
+
+	if err = flock.Lock(a.file, false); err != nil {
+		return
+	}
+
+	if err = a.validateHead(info.Size()); err != nil {
+		return
+	}
+
+	if a.data, err = mmap.Map(a.file, mmap.RDONLY, 0); err != nil {
+		return
+	}
+
+	a.head = utils.BytesToPointer[header](a.data[:a.head.headSize])
+
+	return
+}
+
+// Memory-mapped append-only arena of variable-length blobs
+type Arena struct {
+	data     mmap.MMap
+	file     *os.File
+	head     *header
+	stale    []mmap.MMap // Previous mappings, kept alive until the arena is closed.
+	readonly bool
+}
+
+func (a *Arena) validateHead(fileSize int64) (err error) {
+	if fileSize < int64(a.head.headSize) {
+		return errors.New("file too small")
+	}
+
+	if a.file == nil {
+		return errors.New("file is not open")
+	}
+
+	if _, err = a.file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	b := make([]byte, a.head.headSize)
+
+	if _, err = io.ReadFull(a.file, b); err != nil {
+		return
+	}
+
+	head := utils.BytesToPointer[header](b)
+
+	if err = head.preamble.Validate(&a.head.preamble); err != nil {
+		return
+	}
+
+	if head.headSize != a.head.headSize {
+		return errors.New("invalid header size")
+	}
+
+	// A capacity can never be less than the length
+	if head.capacity < head.length {
+		return errors.New("invalid capacity")
+	}
+
+	if head.garbage > head.length {
+		return errors.New("invalid garbage")
+	}
+
+	// A larger file is left by a grow that was interrupted before the capacity
+	// was updated
+	if fileSize < int64(head.fileSize()) {
+		return errors.New("invalid file size")
+	}
+
+	return
+}
+
+// Truncate the file to the size of the capacity, after a grow that was
+// interrupted before the capacity was updated.
+func (a *Arena) trim(fileSize int64) (err error) {
+	b := make([]byte, a.head.headSize)
+
+	if _, err = a.file.ReadAt(b, 0); err != nil {
+		return
+	}
+
+	if size := int64(utils.BytesToPointer[header](b).fileSize()); fileSize > size {
+		err = a.file.Truncate(size)
+	}
+
+	return
+}
+
+func (a *Arena) Flush() error {
+	return a.data.Flush()
+}
+
+func (a *Arena) Close() (err error) {
+	if err = a.data.Unmap(); err != nil {
+		return
+	}
+
+	for _, data := range a.stale {
+		if err = data.Unmap(); err != nil {
+			return
+		}
+	}
+
+	a.stale = nil
+
+	return a.file.Close()
+}
+
+// Append a copy of a blob, and return a handle to it.
+func (a *Arena) Append(b []byte) (h Handle, err error) {
+	if a.readonly {
+		return h, errors.New("arena is read-only")
+	}
+
+	h.size = uint64(len(b))
+
+	if h.size == 0 {
+		return
+	}
+
+	if a.head.length+h.size > a.head.capacity {
+		capacity := a.head.capacity * 2
+
+		for a.head.length+h.size > capacity {
+			capacity *= 2
+		}
+
+		if err = a.grow(capacity); err != nil {
+			return
+		}
+	}
+
+	h.idx = a.head.length
+	copy(a.Get(h), b)
+	a.head.length += h.size
+
+	return
+}
+
+// Get a blob in place. The blob stays valid until the arena is compacted or
+// closed.
+func (a *Arena) Get(h Handle) []byte {
+	idx := a.head.headSize + h.idx
+	return a.data[idx : idx+h.size : idx+h.size]
+}
+
+// Mark a blob as garbage. Its space is reclaimed on the next compaction.
+func (a *Arena) Free(h Handle) {
+	a.head.garbage += h.size
+}
+
+// Number of bytes in use, including garbage.
+func (a *Arena) Len() int {
+	return int(a.head.length)
+}
+
+func (a *Arena) Cap() int {
+	return int(a.head.capacity)
+}
+
+// Number of bytes that will be reclaimed on the next compaction.
+func (a *Arena) Garbage() int {
+	return int(a.head.garbage)
+}
+
+// Move all live blobs to the start of the arena, and update their handles.
+// The each function must pass every live handle to yield, after which all
+// other blobs are reclaimed. Handles that are equal share the same blob. If
+// each returns an error or any handle is invalid, nothing is changed.
+// Compaction is not crash-safe.
+func (a *Arena) Compact(each func(yield func(h *Handle)) error) (err error) {
+	if a.readonly {
+		return errors.New("arena is read-only")
+	}
+
+	var handles []*Handle
+
+	if err = each(func(h *Handle) {
+		if h.size > 0 {
+			handles = append(handles, h)
+		}
+	}); err != nil {
+		return
+	}
+
+	sort.Slice(handles, func(i, j int) bool {
+		return handles[i].idx < handles[j].idx
+	})
+
+	var end uint64
+
+	for i, h := range handles {
+		if i > 0 && *h == *handles[i-1] {
+			continue
+		}
+
+		if h.idx < end {
+			return errors.New("overlapping handles")
+		}
+
+		if end = h.idx + h.size; end > a.head.length {
+			return errors.New("invalid handle")
+		}
+	}
+
+	var length uint64
+	var prev Handle
+
+	for i, h := range handles {
+		if i > 0 && *h == prev {
+			*h = *handles[i-1]
+			continue
+		}
+
+		prev = *h
+		dst := Handle{idx: length, size: h.size}
+		copy(a.Get(dst), a.Get(*h))
+		*h = dst
+		length += h.size
+	}
+
+	a.head.length = length
+	a.head.garbage = 0
+
+	return
+}
+
+// Grow the arena by extending the file and mapping it again. As the file is
+// extended before the capacity is updated, a grow that is interrupted leaves a
+// larger file, which is truncated when opened again. The previous mapping is
+// kept until the arena is closed, which is bounded by the capacity doubling.
+func (a *Arena) grow(capacity uint64) (err error) {
+	if err = a.Flush(); err != nil {
+		return
+	}
+
+	head := *a.head
+	head.capacity = capacity
+
+	if err = a.file.Truncate(int64(head.fileSize())); err != nil {
+		return
+	}
+
+	data, err := mmap.Map(a.file, mmap.RDWR, 0)
+
+	if err != nil {
+		return
+	}
+
+	a.stale = append(a.stale, a.data)
+	a.data = data
+	a.head = utils.BytesToPointer[header](a.data[:a.head.headSize])
+	a.head.capacity = capacity
+
+	return
+}
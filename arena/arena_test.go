@@ -0,0 +1,259 @@
+package arena
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func blob(i, size int) []byte {
+	return bytes.Repeat([]byte{byte(i + 1)}, size)
+}
+
+func TestArena(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		sizes    []int
+		wantCap  int
+	}{
+		{"fits", 16, []int{4, 8, 4}, 16},
+		{"empty blob", 16, []int{0, 4}, 16},
+		{"doubled", 16, []int{10, 10}, 32},
+		{"doubled repeatedly", 16, []int{100}, 128},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "arena")
+			a, err := New(path, tt.capacity)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handles := make([]Handle, len(tt.sizes))
+			var length int
+
+			for i, size := range tt.sizes {
+				if handles[i], err = a.Append(blob(i, size)); err != nil {
+					t.Fatal(err)
+				}
+
+				length += size
+			}
+
+			check := func() {
+				t.Helper()
+
+				if l, c := a.Len(), a.Cap(); l != length || c != tt.wantCap {
+					t.Fatalf("expected length %d and capacity %d, got %d and %d", length, tt.wantCap, l, c)
+				}
+
+				for i, h := range handles {
+					if b := a.Get(h); !bytes.Equal(b, blob(i, tt.sizes[i])) || h.Len() != tt.sizes[i] {
+						t.Fatalf("blob %d: expected %d bytes, got %v", i, tt.sizes[i], b)
+					}
+				}
+			}
+
+			check()
+
+			if err = a.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if a, err = New(path); err != nil {
+				t.Fatal(err)
+			}
+
+			defer a.Close()
+
+			check()
+		})
+	}
+}
+
+func TestArenaCompact(t *testing.T) {
+	errEach := errors.New("failed")
+
+	tests := []struct {
+		name    string
+		sizes   []int
+		live    []int // Blobs passed to yield, by index.
+		eachErr error
+		wantErr bool
+	}{
+		{"all live", []int{2, 3, 4}, []int{0, 1, 2}, nil, false},
+		{"first freed", []int{2, 3, 4}, []int{1, 2}, nil, false},
+		{"middle freed", []int{2, 3, 4}, []int{2, 0}, nil, false},
+		{"none live", []int{2, 3}, nil, nil, false},
+		{"shared blob", []int{2, 3}, []int{1, 1, 0}, nil, false},
+		{"each fails", []int{2, 3}, []int{1}, errEach, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "arena")
+			a, err := New(path, 16)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handles := make([]Handle, len(tt.sizes))
+
+			for i, size := range tt.sizes {
+				if handles[i], err = a.Append(blob(i, size)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			live := make([]Handle, len(tt.live))
+			var wantLen int
+
+			for i, j := range tt.live {
+				live[i] = handles[j]
+
+				if i == 0 || tt.live[i-1] != j {
+					wantLen += tt.sizes[j]
+				}
+			}
+
+			before := a.Len()
+
+			err = a.Compact(func(yield func(h *Handle)) error {
+				for i := range live {
+					yield(&live[i])
+				}
+
+				return tt.eachErr
+			})
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if tt.wantErr {
+				wantLen = before
+			}
+
+			if l, g := a.Len(), a.Garbage(); l != wantLen || g != 0 {
+				t.Fatalf("expected length %d without garbage, got %d with %d bytes of garbage", wantLen, l, g)
+			}
+
+			if err = a.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if a, err = New(path); err != nil {
+				t.Fatal(err)
+			}
+
+			defer a.Close()
+
+			for i, j := range tt.live {
+				if b := a.Get(live[i]); !bytes.Equal(b, blob(j, tt.sizes[j])) {
+					t.Fatalf("blob %d: expected %v, got %v", j, blob(j, tt.sizes[j]), b)
+				}
+			}
+		})
+	}
+}
+
+func TestArenaCompactInvalidHandle(t *testing.T) {
+	a, err := New(filepath.Join(t.TempDir(), "arena"), 16)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer a.Close()
+
+	h, err := a.Append(blob(0, 4))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := Handle{idx: 2, size: 4}
+
+	if err = a.Compact(func(yield func(h *Handle)) error {
+		yield(&h)
+		yield(&invalid)
+		return nil
+	}); err == nil {
+		t.Fatal("expected error for an invalid handle")
+	}
+
+	if h.idx != 0 || !bytes.Equal(a.Get(h), blob(0, 4)) {
+		t.Fatal("expected the arena to be unchanged")
+	}
+}
+
+func TestArenaInterruptedGrow(t *testing.T) {
+	tests := []struct {
+		name     string
+		open     func(path string) (*Arena, error)
+		wantSize bool // Whether the file is truncated back.
+	}{
+		{"writable", func(path string) (*Arena, error) { return New(path) }, true},
+		{"read-only", OpenRO, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "arena")
+			a, err := New(path, 16)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h, err := a.Append(blob(0, 10))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			size := int64(a.head.fileSize())
+
+			if err = a.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The file is extended before the capacity is updated
+			if err = os.Truncate(path, size+16); err != nil {
+				t.Fatal(err)
+			}
+
+			if a, err = tt.open(path); err != nil {
+				t.Fatal(err)
+			}
+
+			if c := a.Cap(); c != 16 {
+				t.Fatalf("expected capacity 16, got %d", c)
+			}
+
+			if b := a.Get(h); !bytes.Equal(b, blob(0, 10)) {
+				t.Fatalf("expected the blob, got %v", b)
+			}
+
+			if err = a.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := os.Stat(path)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (info.Size() == size) != tt.wantSize {
+				t.Fatalf("expected truncated file %v, got size %d", tt.wantSize, info.Size())
+			}
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package arena
+
+// Reference to a blob in an arena. As it contains no pointers, it can be
+// embedded in items of other memory-mapped data types.
+type Handle struct {
+	idx  uint64
+	size uint64
+}
+
+func (h Handle) Len() int {
+	return int(h.size)
+}
+
+func (h Handle) Empty() bool {
+	return h.size == 0
+}
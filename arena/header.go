@@ -0,0 +1,29 @@
+package arena
+
+import (
+	"unsafe"
+
+	"github.com/webbmaffian/go-mad/internal/preamble"
+)
+
+func newHeader(capacity int) *header {
+	h := &header{
+		preamble: preamble.New(preamble.KindArena),
+		capacity: uint64(capacity),
+	}
+	h.headSize = uint64(unsafe.Sizeof(*h))
+
+	return h
+}
+
+type header struct {
+	preamble preamble.Preamble
+	headSize uint64
+	length   uint64 // Number of bytes in use, including garbage.
+	capacity uint64
+	garbage  uint64 // Number of bytes that have been freed.
+}
+
+func (h header) fileSize() uint64 {
+	return h.headSize + h.capacity
+}
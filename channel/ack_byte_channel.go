@@ -1,60 +1,121 @@
 package channel
 
 import (
+	"context"
 	"errors"
 	"io"
+	"math"
 	"os"
 	"sync"
+	"time"
+	"unsafe"
 
 	"github.com/edsrzf/mmap-go"
+	"github.com/webbmaffian/go-mad/internal/flock"
+	"github.com/webbmaffian/go-mad/internal/shm"
 	"github.com/webbmaffian/go-mad/internal/utils"
 )
 
 type AckByteChannel struct {
 	data          mmap.MMap
-	readCond      sync.Cond // Awaited by readers, notified by writers.
-	writeCond     sync.Cond // Awaited by writers, notified by readers.
+	readable      notifier // Awaited by readers, notified by writers.
+	writable      notifier // Awaited by writers, notified by readers.
 	mu            sync.Mutex
 	file          *os.File
-	head          *header
+	head          *header // Working copy of the header, committed to the store after each change.
+	store         headerStore[header]
+	batch         []Delivery     // Reused by ReadBatch.
+	shared        *syncState     // State shared with other processes, or nil if not opened in shared mode.
+	sleepers      sync.WaitGroup // Goroutines waiting for other processes, that must finish before unmapping.
+	timeout       int64          // Visibility timeout in nanoseconds, or 0 if items never expire.
+	expiresAt     int64          // Earliest time that a delivered item might expire.
+	expiryReads   uint64         // Number of reads known when expiresAt was set.
+	deadLetter    *ByteChannel   // Channel that items are moved to after maxAttempts deliveries, if any.
+	maxAttempts   uint32
+	path          string
+	delayed       *delayHeap // Items written with WriteAt that aren't due yet, or nil if delays aren't enabled.
 	closed        bool
 	closedWriting bool
 }
 
+// Interval at which goroutines waiting for other processes recheck the channel,
+// in case a wake-up is lost.
+const sharedWaitTimeout = 100 * time.Millisecond
+
+// Time to wait for another process to initialize a file that it just created.
+const openTimeout = time.Second
+
+// Everything in the file before the items.
+type ackFileHead struct {
+	slots headerSlots[header]
+	sync  syncState
+}
+
+// State of a channel shared between processes. It's only accessed atomically,
+// and is therefore kept outside of the checksummed header. It's unused unless
+// the channel is opened in shared mode.
+type syncState struct {
+	mu       shm.Mutex
+	readable shm.Event // Notified by writers.
+	writable shm.Event // Notified by readers.
+}
+
+func mapSyncState(data []byte) *syncState {
+	return &utils.BytesToPointer[ackFileHead](data[:unsafe.Sizeof(ackFileHead{})]).sync
+}
+
 func NewAckByteChannel(filepath string, capacity int, itemSize int, allowResize ...bool) (ch *AckByteChannel, err error) {
+	return newAckByteChannel(filepath, capacity, itemSize, false, allowResize...)
+}
+
+// Open or create a channel that can be used by several processes at the same
+// time, e.g. a writer in one process and a reader in another. The lock and the
+// wake-up state are kept in the file, and the channel can't be resized. Opening
+// fails with ErrLocked while the channel is opened with NewAckByteChannel.
+// Closing writing only affects the current process.
+func NewSharedAckByteChannel(filepath string, capacity int, itemSize int) (ch *AckByteChannel, err error) {
+	return newAckByteChannel(filepath, capacity, itemSize, true)
+}
+
+func newAckByteChannel(filepath string, capacity int, itemSize int, shared bool, allowResize ...bool) (ch *AckByteChannel, err error) {
 	ch = &AckByteChannel{
 		head: newHeader(capacity, itemSize),
+		path: filepath,
 	}
 
-	ch.readCond.L = &ch.mu
-	ch.writeCond.L = &ch.mu
+	ch.head.headSize = int64(unsafe.Sizeof(ackFileHead{}))
+	ch.head.slotSize = int64(unsafe.Sizeof(slotState{}))
+
+	defer flock.CloseOnError(&err, &ch.file, &ch.data)
 
 	var created bool
-	info, err := os.Stat(filepath)
 
-	if err == nil {
-		if ch.file, err = os.OpenFile(filepath, os.O_RDWR, 0); err != nil {
-			return
+	if _, err = os.Stat(filepath); os.IsNotExist(err) {
+		if ch.head.capacity == 0 {
+			return nil, errors.New("capacity is mandatory")
 		}
 
-		if err = ch.validateHead(info.Size()); err != nil {
+		// Never truncate a file that another process just created
+		if ch.file, err = os.OpenFile(filepath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666); err == nil {
+			created = true
+		} else if !os.IsExist(err) {
 			return
 		}
-	} else if os.IsNotExist(err) {
-		if ch.head.capacity == 0 {
-			return nil, errors.New("capacity is mandatory")
-		}
+	} else if err != nil {
+		return
+	}
 
-		if ch.file, err = os.Create(filepath); err != nil {
+	if created {
+		// The file is locked exclusively until it's initialized, also in shared
+		// mode, so that other processes wait for it
+		if err = ch.lockCreated(); err != nil {
 			return
 		}
 
 		if err = ch.file.Truncate(int64(ch.head.fileSize())); err != nil {
 			return
 		}
-
-		created = true
-	} else {
+	} else if err = ch.openExisting(filepath, shared); err != nil {
 		return
 	}
 
@@ -62,19 +123,28 @@ func NewAckByteChannel(filepath string, capacity int, itemSize int, allowResize
 		return
 	}
 
+	ch.store.mapSlots(ch.data)
+
+	if shared {
+		ch.shared = mapSyncState(ch.data)
+	}
+
 	if created {
+		ch.store.init(ch.head)
 
-		if s := int(ch.head.headSize); copy(ch.data[:ch.head.headSize], utils.PointerToBytes(ch.head, s)) != s {
-			return nil, errors.New("failed to write header")
+		if err = ch.flush(); err != nil {
+			return
 		}
 
-		if err = ch.Flush(); err != nil {
-			return
+		if shared {
+			if err = flock.Lock(ch.file, false); err != nil {
+				return
+			}
 		}
+	} else if !ch.store.load(ch.head) {
+		return nil, errors.New("corrupt header")
 	}
 
-	ch.head = utils.BytesToPointer[header](ch.data[:ch.head.headSize])
-
 	if ch.needResizing(capacity, itemSize) {
 		if allowResize == nil || !allowResize[0] {
 			ch.Close()
@@ -88,13 +158,78 @@ func NewAckByteChannel(filepath string, capacity int, itemSize int, allowResize
 		return NewAckByteChannel(filepath, capacity, itemSize)
 	}
 
-	// Reset statistics
-	ch.head.itemsWritten = 0
-	ch.head.itemsRead = 0
+	// Reset statistics, unless other processes might be using the channel
+	if !shared {
+		ch.repairStates()
+		ch.head.itemsWritten = 0
+		ch.head.itemsRead = 0
+		ch.commit()
+	}
 
 	return
 }
 
+// Lock a file that was just created. Another process that opens the file
+// before it's locked might hold the lock for a moment, until it sees that the
+// file isn't initialized yet.
+func (ch *AckByteChannel) lockCreated() (err error) {
+	deadline := time.Now().Add(openTimeout)
+
+	for {
+		if err = flock.Lock(ch.file, true); err != flock.ErrLocked || time.Now().After(deadline) {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Open and lock an existing file, and validate its header. If another process
+// has just created the file, it's waited for until the file is initialized.
+func (ch *AckByteChannel) openExisting(filepath string, shared bool) (err error) {
+	deadline := time.Now().Add(openTimeout)
+
+	for {
+		if ch.file, err = os.OpenFile(filepath, os.O_RDWR, 0); err != nil {
+			return
+		}
+
+		lockErr := flock.Lock(ch.file, !shared)
+
+		if lockErr != nil && lockErr != flock.ErrLocked {
+			return lockErr
+		}
+
+		var info os.FileInfo
+
+		if info, err = ch.file.Stat(); err != nil {
+			return
+		}
+
+		headErr := ch.validateHead(info.Size())
+
+		if headErr == nil && lockErr == nil {
+			return
+		}
+
+		// The file is being initialized if it's empty, or if it's locked by the
+		// process that created it. In shared mode, that process holds an
+		// exclusive lock until the file is initialized.
+		initializing := info.Size() == 0 || (lockErr != nil && (shared || headErr != nil))
+
+		if err = headErr; err == nil {
+			err = lockErr
+		}
+
+		if !initializing || time.Now().After(deadline) {
+			return
+		}
+
+		ch.file.Close()
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func (ch *AckByteChannel) validateHead(fileSize int64) (err error) {
 	if fileSize < int64(ch.head.headSize) {
 		return errors.New("file too small")
@@ -114,7 +249,23 @@ func (ch *AckByteChannel) validateHead(fileSize int64) (err error) {
 		return
 	}
 
-	head := utils.BytesToPointer[header](b)
+	slots := utils.BytesToPointer[headerSlots[header]](b)
+
+	if err = slots[0].head.preamble.Validate(&ch.head.preamble); err != nil {
+		return
+	}
+
+	latest := slots.latest()
+
+	if latest == nil {
+		return errors.New("corrupt header")
+	}
+
+	head := &latest.head
+
+	if head.headSize != ch.head.headSize {
+		return errors.New("invalid header size")
+	}
 
 	if head.itemSize < 1 {
 		return errors.New("invalid item size")
@@ -130,6 +281,10 @@ func (ch *AckByteChannel) validateHead(fileSize int64) (err error) {
 		return errors.New("invalid awaiting ack")
 	}
 
+	if head.acked < 0 || head.nacked < 0 || head.acked+head.nacked > head.awaitingAck {
+		return errors.New("invalid acknowledgements")
+	}
+
 	// A capacity can never be less than the length
 	if head.capacity < head.length {
 		return errors.New("invalid capacity")
@@ -143,7 +298,7 @@ func (ch *AckByteChannel) validateHead(fileSize int64) (err error) {
 }
 
 func (ch *AckByteChannel) needResizing(capacity int, itemSize int) bool {
-	return ch.head.capacity != int64(capacity) || ch.head.itemSize != int64(itemSize)
+	return ch.head.capacity != int64(capacity) || ch.head.itemSize != int64(itemSize) || ch.head.slotSize != int64(unsafe.Sizeof(slotState{}))
 }
 
 func (ch *AckByteChannel) resize(filepath string, capacity int, itemSize int) (err error) {
@@ -189,38 +344,50 @@ func (ch *AckByteChannel) CopyTo(dst *AckByteChannel) {
 	}
 
 	dst.head.awaitingAck = 0
+	dst.head.acked = 0
+	dst.head.nacked = 0
+	dst.head.firstSeq = ch.head.firstSeq
 
 	if ch.head.length < dst.head.capacity {
 		dst.head.length = ch.head.length
 	} else {
 		dst.head.length = dst.head.capacity
 	}
+
+	dst.commit()
 }
 
 func (ch *AckByteChannel) WriteOrBlock(cb func([]byte)) bool {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	return ch.WriteCtx(context.Background(), cb) == nil
+}
+
+// Write an item, blocking while the channel is full until the context is done.
+func (ch *AckByteChannel) WriteCtx(ctx context.Context, cb func([]byte)) (err error) {
+	ch.lock()
+	defer ch.unlock()
 
 	if ch.closedWriting {
-		return false
+		return ErrWritingClosed
 	}
 
 	for !ch.spaceLeft() {
 		if ch.closedWriting {
-			return false
+			return ErrWritingClosed
 		}
 
 		// Wait until there is space in the buffer
-		ch.writeCond.Wait()
+		if err = ch.waitWrite(ctx); err != nil {
+			return
+		}
 	}
 
 	ch.write(cb)
-	return true
+	return
 }
 
 func (ch *AckByteChannel) WriteOrFail(cb func([]byte)) bool {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	ch.lock()
+	defer ch.unlock()
 
 	if ch.closedWriting || !ch.spaceLeft() {
 		return false
@@ -231,8 +398,8 @@ func (ch *AckByteChannel) WriteOrFail(cb func([]byte)) bool {
 }
 
 func (ch *AckByteChannel) WriteOrReplace(cb func([]byte)) bool {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	ch.lock()
+	defer ch.unlock()
 
 	if ch.closedWriting {
 		return false
@@ -249,31 +416,94 @@ func (ch *AckByteChannel) write(cb func([]byte)) {
 	if ch.spaceLeft() {
 		ch.head.length++
 	} else {
-		ch.head.startIdx = ch.index(1)
-
-		if ch.toAck() {
+		// The oldest item is replaced, and can never be acknowledged as the
+		// acknowledged items before it would have been removed already
+		if ch.head.awaitingAck > 0 {
 			ch.head.awaitingAck--
+
+			if ch.slot(idx).state == slotNacked {
+				ch.head.nacked--
+			}
 		}
+
+		ch.head.startIdx = ch.index(1)
+		ch.head.firstSeq++
 	}
 
+	*ch.slot(idx) = slotState{}
 	ch.head.itemsWritten++
-	ch.readCond.Signal()
+	ch.commit()
+	ch.wakeReaders()
+}
+
+// Write n items, blocking while the channel is full. As many items as there is
+// space for are written at once, and the callback is called with the index of
+// each item in the batch. Returns the number of items written, which is less
+// than n only if writing is closed.
+func (ch *AckByteChannel) WriteBatch(n int, cb func(i int, b []byte)) (written int) {
+	ch.lock()
+	defer ch.unlock()
+
+	for written < n {
+		for !ch.spaceLeft() {
+			if ch.closedWriting {
+				return
+			}
+
+			// Wait until there is space in the buffer
+			ch.waitWrite(context.Background())
+		}
+
+		if ch.closedWriting {
+			return
+		}
+
+		written += ch.writeBatch(written, n-written, cb)
+	}
+
+	return
+}
+
+// Write up to n items to the free slots, and commit them at once.
+func (ch *AckByteChannel) writeBatch(offset int, n int, cb func(i int, b []byte)) int {
+	if free := ch.head.capacity - ch.head.length; int64(n) > free {
+		n = int(free)
+	}
+
+	for i := 0; i < n; i++ {
+		idx := ch.index(ch.head.length + int64(i))
+		cb(offset+i, ch.slice(idx))
+		*ch.slot(idx) = slotState{}
+	}
+
+	ch.head.length += int64(n)
+	ch.head.itemsWritten += uint64(n)
+	ch.commit()
+	ch.wakeReaders()
+	return n
 }
 
 // Wait until there is anything to read
 func (ch *AckByteChannel) Wait() (unread int64, err error) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	return ch.WaitCtx(context.Background())
+}
+
+// Wait until there is anything to read, or until the context is done.
+func (ch *AckByteChannel) WaitCtx(ctx context.Context) (unread int64, err error) {
+	ch.lock()
+	defer ch.unlock()
 
 	// Wait until there is data in the buffer to read
-	for !ch.toRead() && !ch.closed {
+	for ch.expire(); !ch.toRead() && !ch.closed; ch.expire() {
 
 		// If writing is closed, there will never be any more to read
 		if ch.closedWriting {
 			return 0, ErrWritingClosed
 		}
 
-		ch.readCond.Wait()
+		if err = ch.waitRead(ctx); err != nil {
+			return
+		}
 	}
 
 	if ch.closed {
@@ -285,27 +515,42 @@ func (ch *AckByteChannel) Wait() (unread int64, err error) {
 
 // Wait until something has been read and need to be acknowledged
 func (ch *AckByteChannel) WaitUntilRead() (read int64, err error) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	return ch.WaitUntilReadCtx(context.Background())
+}
+
+// Wait until something has been read and need to be acknowledged, or until the
+// context is done.
+func (ch *AckByteChannel) WaitUntilReadCtx(ctx context.Context) (read int64, err error) {
+	ch.lock()
+	defer ch.unlock()
 
 	for !ch.toAck() && !ch.closed {
-		ch.writeCond.Wait()
+		if err = ch.waitWrite(ctx); err != nil {
+			return
+		}
 	}
 
 	if ch.closed {
 		return 0, ErrClosed
 	}
 
-	return ch.head.awaitingAck, nil
+	return ch.head.inFlight(), nil
 }
 
 // Wait until channel is empty
 func (ch *AckByteChannel) WaitUntilEmpty() (err error) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	return ch.WaitUntilEmptyCtx(context.Background())
+}
+
+// Wait until channel is empty, or until the context is done.
+func (ch *AckByteChannel) WaitUntilEmptyCtx(ctx context.Context) (err error) {
+	ch.lock()
+	defer ch.unlock()
 
 	for !ch.empty() && !ch.closed {
-		ch.writeCond.Wait()
+		if err = ch.waitWrite(ctx); err != nil {
+			return
+		}
 	}
 
 	if ch.closed {
@@ -316,61 +561,709 @@ func (ch *AckByteChannel) WaitUntilEmpty() (err error) {
 }
 
 func (ch *AckByteChannel) ReadToCallback(cb func([]byte) error, undoOnError bool) (err error) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	return ch.ReadDelivery(func(d Delivery) error {
+		return cb(d.Data)
+	}, undoOnError)
+}
+
+// Read the next item. Items that have been rejected with Nack are delivered
+// again before any unread item. The item must be acknowledged with its tag
+// once handled, in any order.
+func (ch *AckByteChannel) ReadDelivery(cb func(d Delivery) error, undoOnError bool) (err error) {
+	ch.lock()
+	defer ch.unlock()
+
+	if ch.closed {
+		return ErrClosed
+	}
+
+	ch.expire()
 
 	// If there is nothing to read, fail
-	if ch.empty() {
+	if !ch.toRead() {
 		return ErrEmpty
 	}
 
-	err = cb(ch.read())
+	offset := ch.read()
+	idx := ch.index(offset)
+	slot := ch.slot(idx)
+	ch.deliver(slot)
+	ch.commit()
 
+	err = cb(Delivery{
+		Tag:      ch.head.firstSeq + uint64(offset),
+		Data:     ch.slice(idx),
+		Attempts: slot.attempts,
+	})
+
+	// The item is delivered again first, unless it's moved to the dead-letter
+	// channel. Either way, the failed attempt is counted.
 	if undoOnError && err != nil {
-		ch.undoRead()
-		ch.readCond.Broadcast()
+		ch.head.itemsRead--
+		ch.retry(offset, err.Error())
+		ch.removeAcked()
+		ch.wakeReaders()
 	} else {
-		ch.writeCond.Broadcast()
+		ch.wakeWriters()
+	}
+
+	return
+}
+
+// Read up to max items at once. Items that have been rejected with Nack are
+// delivered again before any unread item. The items are only marked as
+// delivered if the callback returns nil, and must then be acknowledged with
+// their tags. The data is only valid until the callback returns. An error
+// counts as a failed delivery of every item, which are delivered again or
+// moved to the dead-letter channel.
+func (ch *AckByteChannel) ReadBatch(max int, cb func([]Delivery) error) (err error) {
+	if max < 1 {
+		return errors.New("max must be at least 1")
+	}
+
+	ch.lock()
+	defer ch.unlock()
+
+	if ch.closed {
+		return ErrClosed
+	}
+
+	ch.expire()
+
+	// If there is nothing to read, fail
+	if !ch.toRead() {
+		return ErrEmpty
+	}
+
+	ch.batch = ch.batch[:0]
+
+	for offset := int64(0); ch.head.nacked > 0 && offset < ch.head.awaitingAck && len(ch.batch) < max; offset++ {
+		if ch.slot(ch.index(offset)).state == slotNacked {
+			ch.batch = append(ch.batch, ch.delivery(offset))
+		}
+	}
+
+	for offset := ch.head.awaitingAck; offset < ch.head.length && len(ch.batch) < max; offset++ {
+		ch.batch = append(ch.batch, ch.delivery(offset))
 	}
 
+	if err = cb(ch.batch); err != nil {
+		for _, d := range ch.batch {
+			offset := int64(d.Tag - ch.head.firstSeq)
+
+			if offset >= ch.head.awaitingAck {
+				ch.head.awaitingAck++
+			}
+
+			ch.slot(ch.index(offset)).attempts++
+			ch.retry(offset, err.Error())
+		}
+
+		ch.removeAcked()
+		ch.wakeReaders()
+		return
+	}
+
+	for _, d := range ch.batch {
+		offset := int64(d.Tag - ch.head.firstSeq)
+
+		if offset < ch.head.awaitingAck {
+			ch.setState(offset, slotDelivered)
+		} else {
+			ch.head.awaitingAck++
+		}
+
+		ch.head.itemsRead++
+		ch.deliver(ch.slot(ch.index(offset)))
+	}
+
+	ch.commit()
+	ch.wakeWriters()
 	return
 }
 
-func (ch *AckByteChannel) read() []byte {
-	idx := ch.index(ch.head.awaitingAck)
-	ch.head.awaitingAck++
+// The item at an offset from the start, as it would be delivered next.
+func (ch *AckByteChannel) delivery(offset int64) Delivery {
+	idx := ch.index(offset)
+
+	return Delivery{
+		Tag:      ch.head.firstSeq + uint64(offset),
+		Data:     ch.slice(idx),
+		Attempts: ch.slot(idx).attempts + 1,
+	}
+}
+
+// Call the callback with the next item to deliver without delivering it. The
+// slice is only valid until the callback returns.
+func (ch *AckByteChannel) Peek(cb func([]byte) error) (err error) {
+	ch.lock()
+	defer ch.unlock()
+
+	if ch.closed {
+		return ErrClosed
+	}
+
+	ch.expire()
+
+	// If there is nothing to read, fail
+	if !ch.toRead() {
+		return ErrEmpty
+	}
+
+	offset := ch.nextNacked()
+
+	if offset < 0 {
+		offset = ch.head.awaitingAck
+	}
+
+	return cb(ch.slice(ch.index(offset)))
+}
+
+// Record the layout of the item type of a typed channel. Fails if the channel
+// was created for another type.
+func (ch *AckByteChannel) setFingerprint(fingerprint uint64) error {
+	ch.lock()
+	defer ch.unlock()
+
+	if ch.head.fingerprint != fingerprint {
+		if ch.head.fingerprint != 0 {
+			return errors.New("invalid fingerprint - the layout of the type has changed")
+		}
+
+		ch.head.fingerprint = fingerprint
+		ch.commit()
+	}
+
+	return nil
+}
+
+// Mark the next item as delivered, and return its offset from the start.
+func (ch *AckByteChannel) read() (offset int64) {
+	if offset = ch.nextNacked(); offset >= 0 {
+		ch.setState(offset, slotDelivered)
+	} else {
+		offset = ch.head.awaitingAck
+		ch.head.awaitingAck++
+	}
+
 	ch.head.itemsRead++
-	return ch.slice(idx)
+	return
+}
+
+// Enable WriteAt, with space for a number of delayed items. The delayed items
+// are kept in "<filepath>.delayed" until they are due, and survive restarts as
+// long as delays are enabled again after opening the channel. Delays aren't
+// supported in shared mode.
+func (ch *AckByteChannel) EnableDelays(capacity int) (err error) {
+	ch.lock()
+	defer ch.unlock()
+
+	if ch.closed {
+		return ErrClosed
+	}
+
+	if ch.shared != nil {
+		return errors.New("delays aren't supported in shared mode")
+	}
+
+	if ch.delayed != nil {
+		return errors.New("delays are already enabled")
+	}
+
+	if ch.delayed, err = openDelayHeap(ch.path+".delayed", capacity, ch.head.itemSize); err != nil {
+		return
+	}
+
+	ch.promote()
+	ch.readable.broadcast()
+	return
+}
+
+// Write an item that isn't delivered before a time. Until then, it's kept
+// aside and isn't counted by Len. Once due, it's moved into the channel as soon
+// as there is space, after any item already in it. Fails with ErrFull if there
+// is no space for more delayed items.
+func (ch *AckByteChannel) WriteAt(notBefore time.Time, cb func([]byte)) (err error) {
+	ch.lock()
+	defer ch.unlock()
+
+	if ch.closedWriting {
+		return ErrWritingClosed
+	}
+
+	if ch.delayed == nil {
+		return errors.New("delays aren't enabled")
+	}
+
+	if !ch.delayed.push(notBefore.UnixNano(), cb) {
+		return ErrFull
+	}
+
+	// Waiting readers must learn about an earlier due time
+	ch.promote()
+	ch.readable.broadcast()
+	return
+}
+
+// Move delayed items that are due into the channel, as long as there is space.
+// An item is removed from the delayed items only after it's written, so a crash
+// in between delivers it twice rather than never.
+func (ch *AckByteChannel) promote() {
+	if ch.delayed == nil {
+		return
+	}
+
+	now := time.Now().UnixNano()
+
+	for ch.spaceLeft() {
+		due, item, ok := ch.delayed.peek()
+
+		if !ok || due > now {
+			return
+		}
+
+		ch.write(func(b []byte) {
+			copy(b, item)
+		})
+
+		ch.delayed.pop()
+	}
+}
+
+// Number of delayed items that haven't been moved into the channel yet.
+func (ch *AckByteChannel) Delayed() int64 {
+	ch.lock()
+	defer ch.unlock()
+
+	if ch.delayed == nil || ch.closed {
+		return 0
+	}
+
+	ch.promote()
+	return ch.delayed.len()
+}
+
+// Move items to a dead-letter channel once they have been delivered
+// maxAttempts times without being acknowledged, together with the reason of
+// the last failure. The item size of the dead-letter channel must be
+// DeadLetterSize of the item size. If the dead-letter channel is full, items
+// are delivered again as usual. A nil channel disables dead letters.
+func (ch *AckByteChannel) SetDeadLetter(dlq *ByteChannel, maxAttempts int) (err error) {
+	if dlq != nil {
+		if err = validateDeadLetter(dlq, ch.head.itemSize); err != nil {
+			return
+		}
+	}
+
+	ch.lock()
+	defer ch.unlock()
+
+	ch.deadLetter = dlq
+	ch.maxAttempts = uint32(maxAttempts)
+	return
+}
+
+// Deliver an item that has failed again, or move it to the dead-letter channel
+// if it has been delivered too many times. Moved items are acknowledged, and
+// must be removed with removeAcked.
+func (ch *AckByteChannel) retry(offset int64, reason string) {
+	idx := ch.index(offset)
+	attempts := ch.slot(idx).attempts
+
+	if ch.deadLetter != nil && ch.maxAttempts > 0 && attempts >= ch.maxAttempts {
+		if ch.deadLetter.WriteOrFail(func(b []byte) {
+			writeDeadLetter(b, ch.slice(idx), attempts, reason)
+		}) {
+			ch.setState(offset, slotAcked)
+			return
+		}
+	}
+
+	ch.setState(offset, slotNacked)
+}
+
+// Record a delivery of an item, that expires after the visibility timeout.
+func (ch *AckByteChannel) deliver(slot *slotState) {
+	slot.attempts++
+	slot.deliveredAt = time.Now().UnixNano()
+
+	if ch.timeout > 0 && ch.expiryReads == ch.head.itemsRead-1 {
+		if expiresAt := slot.deliveredAt + ch.timeout; expiresAt < ch.expiresAt {
+			ch.expiresAt = expiresAt
+		}
+
+		ch.expiryReads++
+	}
+}
+
+// Items that aren't acknowledged within the visibility timeout are delivered
+// again. By default, items never expire.
+func (ch *AckByteChannel) SetVisibilityTimeout(timeout time.Duration) {
+	ch.lock()
+	defer ch.unlock()
+
+	ch.timeout = int64(timeout)
+	ch.expiresAt = 0
+	ch.readable.broadcast()
+}
+
+// Reject delivered items that weren't acknowledged within the visibility
+// timeout, so that they are delivered again. Delayed items that are due are
+// moved into the channel first.
+func (ch *AckByteChannel) expire() {
+	ch.promote()
+
+	if ch.timeout <= 0 {
+		return
+	}
+
+	// Reads by other processes might have changed the earliest expiry
+	if ch.expiryReads != ch.head.itemsRead {
+		ch.expiresAt = 0
+	}
+
+	now := time.Now().UnixNano()
+
+	if now < ch.expiresAt {
+		return
+	}
+
+	var count int64
+	ch.expiresAt = math.MaxInt64
+	ch.expiryReads = ch.head.itemsRead
+
+	for i := int64(0); i < ch.head.awaitingAck; i++ {
+		slot := ch.slot(ch.index(i))
+
+		if slot.state != slotDelivered {
+			continue
+		}
+
+		if expiresAt := slot.deliveredAt + ch.timeout; expiresAt <= now {
+			ch.retry(i, "visibility timeout expired")
+			count++
+		} else if expiresAt < ch.expiresAt {
+			ch.expiresAt = expiresAt
+		}
+	}
+
+	if count > 0 {
+		ch.removeAcked()
+		ch.wakeReaders()
+	}
 }
 
-func (ch *AckByteChannel) undoRead() {
-	ch.head.startIdx = ch.index(-1)
-	ch.head.length++
-	ch.head.awaitingAck--
-	ch.head.itemsRead--
+// Offset of the oldest item to deliver again, or -1 if none.
+func (ch *AckByteChannel) nextNacked() int64 {
+	if ch.head.nacked == 0 {
+		return -1
+	}
+
+	for i := int64(0); i < ch.head.awaitingAck; i++ {
+		if ch.slot(ch.index(i)).state == slotNacked {
+			return i
+		}
+	}
+
+	return -1
 }
 
-func (ch *AckByteChannel) Ack() {
+// Lock the channel. In shared mode, the lock is also held against other
+// processes, and the working copy of the header is reloaded from the file.
+func (ch *AckByteChannel) lock() {
 	ch.mu.Lock()
-	defer ch.mu.Unlock()
 
-	if !ch.toAck() {
+	if ch.shared != nil && !ch.closed {
+		tookOver := ch.shared.mu.Lock()
+		ch.store.load(ch.head)
+
+		// The process holding the lock died, possibly after changing states
+		if tookOver {
+			ch.repairStates()
+			ch.commit()
+		}
+	}
+}
+
+func (ch *AckByteChannel) unlock() {
+	if ch.shared != nil && !ch.closed {
+		ch.shared.mu.Unlock()
+	}
+
+	ch.mu.Unlock()
+}
+
+// Wait for writers while holding the lock, until notified, until the context
+// is done, until a delivered item might expire or until a delayed item is due.
+func (ch *AckByteChannel) waitRead(ctx context.Context) (err error) {
+	deadline := int64(math.MaxInt64)
+
+	if ch.timeout > 0 {
+		deadline = ch.expiresAt
+	}
+
+	// Delayed items can't be moved into a full channel
+	if ch.delayed != nil && ch.spaceLeft() {
+		if due := ch.delayed.next(); due < deadline {
+			deadline = due
+		}
+	}
+
+	if deadline < math.MaxInt64 {
+		expiryCtx, cancel := context.WithDeadline(ctx, time.Unix(0, deadline))
+		defer cancel()
+
+		if err = ch.waitReadCtx(expiryCtx); ctx.Err() == nil {
+			err = nil
+		}
+
 		return
 	}
 
-	ch.head.awaitingAck--
-	ch.head.length--
+	return ch.waitReadCtx(ctx)
+}
 
-	if ch.head.length > 0 {
-		ch.head.startIdx = ch.index(1)
+func (ch *AckByteChannel) waitReadCtx(ctx context.Context) error {
+	if ch.shared == nil {
+		return ch.readable.wait(ctx, &ch.mu)
+	}
+
+	return ch.waitShared(ctx, &ch.shared.readable)
+}
+
+// Wait for readers while holding the lock, until notified or until the context
+// is done.
+func (ch *AckByteChannel) waitWrite(ctx context.Context) error {
+	if ch.shared == nil {
+		return ch.writable.wait(ctx, &ch.mu)
 	}
 
-	ch.writeCond.Broadcast()
+	return ch.waitShared(ctx, &ch.shared.writable)
+}
+
+// Other processes can't close a Go channel, so the shared event is polled for
+// the context to be done.
+func (ch *AckByteChannel) waitShared(ctx context.Context, ev *shm.Event) (err error) {
+	if ch.closed {
+		return
+	}
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	timeout := sharedWaitTimeout
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if until := time.Until(deadline); until < timeout {
+			timeout = until
+		}
+	}
+
+	seq := ev.Seq()
+	ch.sleepers.Add(1)
+	ch.unlock()
+
+	if timeout > 0 {
+		ev.Wait(seq, timeout)
+	}
+
+	ch.sleepers.Done()
+	ch.lock()
+	return ctx.Err()
+}
+
+func (ch *AckByteChannel) wakeReaders() {
+	ch.readable.broadcast()
+
+	if ch.shared != nil {
+		ch.shared.readable.Notify()
+	}
+}
+
+func (ch *AckByteChannel) wakeWriters() {
+	ch.writable.broadcast()
+
+	if ch.shared != nil {
+		ch.shared.writable.Notify()
+	}
+}
+
+func (ch *AckByteChannel) commit() {
+	ch.store.commit(ch.head)
+}
+
+// Acknowledge the items with the given delivery tags, or the oldest delivered
+// item if no tag is given. Fails with ErrUnknownTag if any of the items isn't
+// awaiting acknowledgement, but the other items are still acknowledged.
+func (ch *AckByteChannel) Ack(tags ...uint64) (err error) {
+	ch.lock()
+	defer ch.unlock()
+
+	if tags == nil {
+		if offset := ch.nextDelivered(0); offset >= 0 {
+			ch.setState(offset, slotAcked)
+		}
+	}
+
+	for _, tag := range tags {
+		offset, ok := ch.offset(tag)
+
+		if !ok || ch.slot(ch.index(offset)).state == slotAcked {
+			err = ErrUnknownTag
+			continue
+		}
+
+		ch.setState(offset, slotAcked)
+	}
+
+	ch.removeAcked()
+	return
+}
+
+// Reject the items with the given delivery tags, or the oldest delivered item
+// if no tag is given, so that they are delivered again or moved to the
+// dead-letter channel. Fails with
+// ErrUnknownTag if any of the items isn't awaiting acknowledgement, but the
+// other items are still rejected.
+func (ch *AckByteChannel) Nack(tags ...uint64) (err error) {
+	ch.lock()
+	defer ch.unlock()
+
+	if tags == nil {
+		if offset := ch.nextDelivered(0); offset >= 0 {
+			ch.retry(offset, "rejected")
+		}
+	}
+
+	for _, tag := range tags {
+		offset, ok := ch.offset(tag)
+
+		if !ok || ch.slot(ch.index(offset)).state != slotDelivered {
+			err = ErrUnknownTag
+			continue
+		}
+
+		ch.retry(offset, "rejected")
+	}
+
+	ch.removeAcked()
+	ch.wakeReaders()
+	return
+}
+
+// Acknowledge up to n of the oldest delivered items at once. Returns the
+// number of acknowledged items.
+func (ch *AckByteChannel) AckN(n int) (acked int) {
+	ch.lock()
+	defer ch.unlock()
+
+	for offset := ch.nextDelivered(0); offset >= 0 && acked < n; offset = ch.nextDelivered(offset + 1) {
+		ch.setState(offset, slotAcked)
+		acked++
+	}
+
+	ch.removeAcked()
+	return
+}
+
+// Offset of the item with a delivery tag, if it's awaiting acknowledgement.
+func (ch *AckByteChannel) offset(tag uint64) (offset int64, ok bool) {
+	if tag < ch.head.firstSeq || tag-ch.head.firstSeq >= uint64(ch.head.awaitingAck) {
+		return
+	}
+
+	return int64(tag - ch.head.firstSeq), true
+}
+
+// Offset of the oldest delivered item from an offset, or -1 if none.
+func (ch *AckByteChannel) nextDelivered(from int64) int64 {
+	for i := from; i < ch.head.awaitingAck; i++ {
+		if ch.slot(ch.index(i)).state == slotDelivered {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (ch *AckByteChannel) setState(offset int64, state uint32) {
+	slot := ch.slot(ch.index(offset))
+
+	switch slot.state {
+	case slotAcked:
+		ch.head.acked--
+	case slotNacked:
+		ch.head.nacked--
+	}
+
+	switch state {
+	case slotAcked:
+		ch.head.acked++
+	case slotNacked:
+		ch.head.nacked++
+	}
+
+	slot.state = state
+}
+
+// The states of items are changed in place, but the counters of acknowledged
+// and rejected items only when the header is committed. After a crash in
+// between, the counters are recomputed from the states, and items that were
+// never delivered according to the header get their initial state.
+func (ch *AckByteChannel) repairStates() {
+	var acked, nacked int64
+
+	for offset := int64(0); offset < ch.head.capacity; offset++ {
+		slot := ch.slot(ch.index(offset))
+
+		if offset >= ch.head.awaitingAck {
+			slot.state = slotDelivered
+			continue
+		}
+
+		switch slot.state {
+		case slotAcked:
+			acked++
+		case slotNacked:
+			nacked++
+		}
+	}
+
+	ch.head.acked, ch.head.nacked = acked, nacked
+}
+
+// Remove the acknowledged items at the start of the channel, and commit.
+func (ch *AckByteChannel) removeAcked() {
+	var count int64
+
+	for count < ch.head.awaitingAck && ch.slot(ch.index(count)).state == slotAcked {
+		count++
+	}
+
+	if count > 0 {
+		ch.head.startIdx = ch.index(count)
+		ch.head.firstSeq += uint64(count)
+		ch.head.awaitingAck -= count
+		ch.head.acked -= count
+		ch.head.length -= count
+	}
+
+	ch.commit()
+
+	if count > 0 {
+		ch.wakeWriters()
+
+		// There might be space for delayed items that are due
+		if ch.delayed != nil && ch.delayed.len() > 0 {
+			ch.wakeReaders()
+		}
+	}
 }
 
 func (ch *AckByteChannel) Flush() error {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	ch.lock()
+	defer ch.unlock()
 
 	return ch.flush()
 }
@@ -380,49 +1273,79 @@ func (ch *AckByteChannel) flush() error {
 }
 
 func (ch *AckByteChannel) CloseWriting() {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	ch.lock()
+	defer ch.unlock()
 
 	if !ch.closedWriting {
 		ch.closedWriting = true
-		ch.readCond.Signal()
+		ch.wakeReaders()
 	}
 }
 
 func (ch *AckByteChannel) Close() (err error) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	ch.lock()
+	defer ch.unlock()
+
+	if ch.closed {
+		return
+	}
+
+	if ch.shared != nil {
+		ch.shared.mu.Unlock()
+	}
 
 	ch.closed = true
 	ch.closedWriting = true
-	ch.readCond.Broadcast()
-	ch.writeCond.Broadcast()
+	ch.wakeReaders()
+	ch.wakeWriters()
+
+	// Goroutines waiting for other processes must leave the mapping before it's released
+	ch.mu.Unlock()
+	ch.sleepers.Wait()
+	ch.mu.Lock()
+
+	if ch.delayed != nil {
+		if err = ch.delayed.close(); err != nil {
+			return
+		}
+	}
 
 	if err = ch.flush(); err != nil {
 		return
 	}
 
+	// The mapping must be released for the lock of the file to be released
+	if err = ch.data.Unmap(); err != nil {
+		return
+	}
+
 	return ch.file.Close()
 }
 
+// Reject all delivered items, so that they are delivered again. Returns the
+// number of rejected items.
 func (ch *AckByteChannel) Rewind() (count int64) {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	ch.lock()
+	defer ch.unlock()
 
-	count = ch.head.awaitingAck
-	ch.head.awaitingAck = 0
+	for offset := ch.nextDelivered(0); offset >= 0; offset = ch.nextDelivered(offset + 1) {
+		ch.setState(offset, slotNacked)
+		count++
+	}
 
 	if count > 0 {
-		ch.readCond.Broadcast()
+		ch.commit()
+		ch.wakeReaders()
 	}
 
 	return
 }
 
 func (ch *AckByteChannel) ToRead() bool {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	ch.lock()
+	defer ch.unlock()
 
+	ch.expire()
 	return ch.toRead()
 }
 
@@ -431,14 +1354,14 @@ func (ch *AckByteChannel) toRead() bool {
 }
 
 func (ch *AckByteChannel) ToAck() bool {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	ch.lock()
+	defer ch.unlock()
 
 	return ch.toAck()
 }
 
 func (ch *AckByteChannel) toAck() bool {
-	return ch.head.awaitingAck > 0
+	return ch.head.inFlight() > 0
 }
 
 func (ch *AckByteChannel) spaceLeft() bool {
@@ -446,8 +1369,8 @@ func (ch *AckByteChannel) spaceLeft() bool {
 }
 
 func (ch *AckByteChannel) Empty() bool {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	ch.lock()
+	defer ch.unlock()
 
 	return ch.empty()
 }
@@ -457,8 +1380,8 @@ func (ch *AckByteChannel) empty() bool {
 }
 
 func (ch *AckByteChannel) Len() int64 {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	ch.lock()
+	defer ch.unlock()
 
 	return ch.len()
 }
@@ -467,44 +1390,57 @@ func (ch *AckByteChannel) len() int64 {
 	return ch.head.length
 }
 
+func (ch *AckByteChannel) Cap() int64 {
+	ch.lock()
+	defer ch.unlock()
+
+	return ch.head.capacity
+}
+
 func (ch *AckByteChannel) Unread() int64 {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	ch.lock()
+	defer ch.unlock()
 
+	ch.expire()
 	return ch.unread()
 }
 
 func (ch *AckByteChannel) unread() int64 {
-	return ch.head.length - ch.head.awaitingAck
+	return ch.head.unread()
 }
 
+// Number of delivered items that are neither acknowledged nor rejected.
 func (ch *AckByteChannel) AwaitingAck() int64 {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	ch.lock()
+	defer ch.unlock()
 
-	return ch.head.awaitingAck
+	return ch.head.inFlight()
 }
 
 func (ch *AckByteChannel) Reset() {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	ch.lock()
+	defer ch.unlock()
 
+	ch.head.firstSeq += uint64(ch.head.length)
 	ch.head.startIdx = 0
 	ch.head.awaitingAck = 0
+	ch.head.acked = 0
+	ch.head.nacked = 0
 	ch.head.length = 0
-	ch.writeCond.Broadcast()
+	ch.commit()
+	ch.wakeWriters()
 }
 
 func (ch *AckByteChannel) ItemsWritten() uint64 {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	ch.lock()
+	defer ch.unlock()
 
 	return ch.head.itemsWritten
 }
 
 func (ch *AckByteChannel) ItemsRead() uint64 {
-	ch.mu.Lock()
-	defer ch.mu.Unlock()
+	ch.lock()
+	defer ch.unlock()
 
 	return ch.head.itemsRead
 }
@@ -515,6 +1451,12 @@ func (ch *AckByteChannel) slice(index int64) []byte {
 	return ch.data[index : index+ch.head.itemSize]
 }
 
+func (ch *AckByteChannel) slot(index int64) *slotState {
+	index *= ch.head.slotSize
+	index += ch.head.headSize + ch.head.capacity*ch.head.itemSize
+	return utils.BytesToPointer[slotState](ch.data[index : index+ch.head.slotSize])
+}
+
 func (ch *AckByteChannel) index(index int64) int64 {
 	return ch.wrap(ch.head.startIdx + index)
 }
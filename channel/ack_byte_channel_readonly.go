@@ -4,29 +4,39 @@ import (
 	"errors"
 	"io"
 	"os"
+	"unsafe"
 
 	"github.com/edsrzf/mmap-go"
+	"github.com/webbmaffian/go-mad/internal/flock"
 	"github.com/webbmaffian/go-mad/internal/utils"
 )
 
 type AckByteChannelReadonly struct {
-	data mmap.MMap
-	file *os.File
-	head *header
+	data  mmap.MMap
+	file  *os.File
+	head  *header // Last valid copy of the header.
+	store headerStore[header]
 }
 
+// Open a channel file for inspection. The file isn't locked, so that it can be
+// monitored while another process is writing to it. The header is reloaded on
+// every call, and the last valid copy is used while the header is written.
 func OpenAckByteChannelReadonly(filepath string) (ch *AckByteChannelReadonly, err error) {
 	ch = &AckByteChannelReadonly{
 		head: newHeader(0, 0),
 	}
 
+	ch.head.headSize = int64(unsafe.Sizeof(ackFileHead{}))
+
+	defer flock.CloseOnError(&err, &ch.file, &ch.data)
+
 	info, err := os.Stat(filepath)
 
 	if err != nil {
 		return
 	}
 
-	if ch.file, err = os.OpenFile(filepath, os.O_RDWR, 0); err != nil {
+	if ch.file, err = os.OpenFile(filepath, os.O_RDONLY, 0); err != nil {
 		return
 	}
 
@@ -34,11 +44,15 @@ func OpenAckByteChannelReadonly(filepath string) (ch *AckByteChannelReadonly, er
 		return
 	}
 
-	if ch.data, err = mmap.Map(ch.file, mmap.RDWR, 0); err != nil {
+	if ch.data, err = mmap.Map(ch.file, mmap.RDONLY, 0); err != nil {
 		return
 	}
 
-	ch.head = utils.BytesToPointer[header](ch.data[:ch.head.headSize])
+	ch.store.mapSlots(ch.data)
+
+	if !ch.store.load(ch.head) {
+		return nil, errors.New("corrupt header")
+	}
 
 	return
 }
@@ -62,7 +76,23 @@ func (ch *AckByteChannelReadonly) validateHead(fileSize int64) (err error) {
 		return
 	}
 
-	head := utils.BytesToPointer[header](b)
+	slots := utils.BytesToPointer[headerSlots[header]](b)
+
+	if err = slots[0].head.preamble.Validate(&ch.head.preamble); err != nil {
+		return
+	}
+
+	latest := slots.latest()
+
+	if latest == nil {
+		return errors.New("corrupt header")
+	}
+
+	head := &latest.head
+
+	if head.headSize != ch.head.headSize {
+		return errors.New("invalid header size")
+	}
 
 	if head.itemSize < 1 {
 		return errors.New("invalid item size")
@@ -91,7 +121,7 @@ func (ch *AckByteChannelReadonly) validateHead(fileSize int64) (err error) {
 }
 
 func (ch *AckByteChannelReadonly) StartIndex() int64 {
-	return ch.head.startIdx
+	return ch.header().startIdx
 }
 
 func (ch *AckByteChannelReadonly) Cap() int64 {
@@ -111,11 +141,15 @@ func (ch *AckByteChannelReadonly) peek(index int64) []byte {
 }
 
 func (ch *AckByteChannelReadonly) Close() (err error) {
+	if err = ch.data.Unmap(); err != nil {
+		return
+	}
+
 	return ch.file.Close()
 }
 
 func (ch *AckByteChannelReadonly) Len() int64 {
-	return ch.head.length
+	return ch.header().length
 }
 
 func (ch *AckByteChannelReadonly) Unread() int64 {
@@ -123,19 +157,26 @@ func (ch *AckByteChannelReadonly) Unread() int64 {
 }
 
 func (ch *AckByteChannelReadonly) unread() int64 {
-	return ch.head.length - ch.head.awaitingAck
+	return ch.header().unread()
 }
 
 func (ch *AckByteChannelReadonly) AwaitingAck() int64 {
-	return ch.head.awaitingAck
+	return ch.header().inFlight()
 }
 
 func (ch *AckByteChannelReadonly) ItemsWritten() uint64 {
-	return ch.head.itemsWritten
+	return ch.header().itemsWritten
 }
 
 func (ch *AckByteChannelReadonly) ItemsRead() uint64 {
-	return ch.head.itemsRead
+	return ch.header().itemsRead
+}
+
+// Reload the header, as it's continuously changed by the writing process. If
+// no copy is valid at the moment, the last valid one is kept.
+func (ch *AckByteChannelReadonly) header() *header {
+	ch.store.load(ch.head)
+	return ch.head
 }
 
 func (ch *AckByteChannelReadonly) slice(index int64) []byte {
@@ -145,7 +186,7 @@ func (ch *AckByteChannelReadonly) slice(index int64) []byte {
 }
 
 func (ch *AckByteChannelReadonly) index(index int64) int64 {
-	return ch.wrap(ch.head.startIdx + index)
+	return ch.wrap(ch.header().startIdx + index)
 }
 
 func (ch *AckByteChannelReadonly) indexDiff(left, right int64) int64 {
@@ -0,0 +1,55 @@
+package channel
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAckByteChannelReadonly(t *testing.T) {
+	tests := []struct {
+		name string
+		open func(path string) (*AckByteChannel, error)
+	}{
+		{"exclusive", func(path string) (*AckByteChannel, error) { return NewAckByteChannel(path, 4, 1) }},
+		{"shared", func(path string) (*AckByteChannel, error) { return NewSharedAckByteChannel(path, 4, 1) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ch")
+			ch, err := tt.open(path)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer ch.Close()
+
+			writeAck(t, ch, 1, 2)
+
+			// The channel is monitored while it's open for writing
+			ro, err := OpenAckByteChannelReadonly(path)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer ro.Close()
+
+			if l, c := ro.Len(), ro.Cap(); l != 2 || c != 4 {
+				t.Fatalf("expected length 2 and capacity 4, got %d and %d", l, c)
+			}
+
+			writeAck(t, ch, 3)
+			readAck(t, ch)
+
+			if l, n, u := ro.Len(), ro.AwaitingAck(), ro.Unread(); l != 3 || n != 1 || u != 2 {
+				t.Fatalf("expected length 3, 1 awaiting acknowledgement and 2 unread, got %d, %d and %d", l, n, u)
+			}
+
+			if w, r := ro.ItemsWritten(), ro.ItemsRead(); w != 3 || r != 1 {
+				t.Fatalf("expected 3 written and 1 read, got %d and %d", w, r)
+			}
+		})
+	}
+}
@@ -0,0 +1,792 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/webbmaffian/go-mad/internal/flock"
+)
+
+func writeAck(t *testing.T, ch *AckByteChannel, vals ...byte) {
+	t.Helper()
+
+	for _, v := range vals {
+		if !ch.WriteOrFail(func(b []byte) { b[0] = v }) {
+			t.Fatalf("failed to write %d", v)
+		}
+	}
+}
+
+func TestSharedAckByteChannel(t *testing.T) {
+	tests := []struct {
+		name        string
+		write       []byte
+		read        int
+		ack         int // Number of read items to acknowledge.
+		wantLen     int64
+		awaitingAck int64
+	}{
+		{"empty", nil, 0, 0, 0, 0},
+		{"unread", []byte{1, 2, 3}, 0, 0, 3, 0},
+		{"read", []byte{1, 2, 3}, 2, 0, 3, 2},
+		{"acknowledged", []byte{1, 2, 3}, 2, 2, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ch")
+			producer, err := NewSharedAckByteChannel(path, 4, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			consumer, err := NewSharedAckByteChannel(path, 4, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = NewAckByteChannel(path, 4, 1); !errors.Is(err, flock.ErrLocked) {
+				t.Fatalf("expected ErrLocked, got %v", err)
+			}
+
+			writeAck(t, producer, tt.write...)
+
+			for i := 0; i < tt.read; i++ {
+				if err = consumer.ReadToCallback(func(b []byte) error {
+					if b[0] != tt.write[i] {
+						t.Fatalf("expected %d, got %d", tt.write[i], b[0])
+					}
+
+					return nil
+				}, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The oldest items are acknowledged first
+			for i := 0; i < tt.ack; i++ {
+				consumer.Ack()
+			}
+
+			// Both handles see the same state
+			for _, ch := range []*AckByteChannel{producer, consumer} {
+				if l, n := ch.Len(), ch.AwaitingAck(); l != tt.wantLen || n != tt.awaitingAck {
+					t.Fatalf("expected length %d and %d awaiting acknowledgement, got %d and %d", tt.wantLen, tt.awaitingAck, l, n)
+				}
+			}
+
+			if err = producer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = consumer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if consumer, err = NewSharedAckByteChannel(path, 4, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			defer consumer.Close()
+
+			if l, n := consumer.Len(), consumer.AwaitingAck(); l != tt.wantLen || n != tt.awaitingAck {
+				t.Fatalf("expected length %d and %d awaiting acknowledgement after reopening, got %d and %d", tt.wantLen, tt.awaitingAck, l, n)
+			}
+		})
+	}
+}
+
+func TestSharedAckByteChannelInterleaved(t *testing.T) {
+	const n = 1000
+
+	path := filepath.Join(t.TempDir(), "ch")
+	producer, err := NewSharedAckByteChannel(path, 4, 2)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer producer.Close()
+
+	consumer, err := NewSharedAckByteChannel(path, 4, 2)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer consumer.Close()
+
+	// The producer blocks while the channel is full, until the consumer has
+	// acknowledged items through its own handle
+	go func() {
+		for i := 0; i < n; i++ {
+			producer.WriteOrBlock(func(b []byte) {
+				b[0], b[1] = byte(i), byte(i>>8)
+			})
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		if _, err = consumer.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = consumer.ReadToCallback(func(b []byte) error {
+			if v := int(b[0]) | int(b[1])<<8; v != i {
+				t.Fatalf("expected %d, got %d", i, v)
+			}
+
+			return nil
+		}, false); err != nil {
+			t.Fatal(err)
+		}
+
+		consumer.Ack()
+	}
+
+	if !consumer.Empty() {
+		t.Fatalf("expected an empty channel, got length %d", consumer.Len())
+	}
+}
+
+func readAck(t *testing.T, ch *AckByteChannel) Delivery {
+	t.Helper()
+
+	var d Delivery
+
+	if err := ch.ReadDelivery(func(del Delivery) error {
+		d = del
+		d.Data = append([]byte(nil), del.Data...)
+		return nil
+	}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func TestAckByteChannelOutOfOrderAcks(t *testing.T) {
+	tests := []struct {
+		name      string
+		ack       []int // Items to acknowledge, by the order they were read.
+		nack      []int // Items to reject.
+		wantLen   int64
+		inFlight  int64
+		redeliver []byte
+	}{
+		{"in order", []int{0, 1, 2, 3}, nil, 0, 0, nil},
+		{"out of order", []int{3, 1}, nil, 4, 2, nil},
+		{"out of order then first", []int{3, 1, 0}, nil, 2, 1, nil},
+		{"nack", []int{1, 3}, []int{2, 0}, 4, 0, []byte{0, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ch")
+			ch, err := NewAckByteChannel(path, 4, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writeAck(t, ch, 0, 1, 2, 3)
+			tags := make([]uint64, 4)
+
+			for i := range tags {
+				tags[i] = readAck(t, ch).Tag
+			}
+
+			settled := make(map[int]bool)
+
+			for _, i := range tt.ack {
+				if err = ch.Ack(tags[i]); err != nil {
+					t.Fatal(err)
+				}
+
+				settled[i] = true
+			}
+
+			for _, i := range tt.nack {
+				if err = ch.Nack(tags[i]); err != nil {
+					t.Fatal(err)
+				}
+
+				settled[i] = true
+			}
+
+			// An item can't be acknowledged twice
+			if len(tt.ack) > 0 {
+				if err = ch.Ack(tags[tt.ack[0]]); err != ErrUnknownTag {
+					t.Fatalf("expected ErrUnknownTag, got %v", err)
+				}
+			}
+
+			if err = ch.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if ch, err = NewAckByteChannel(path, 4, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			defer ch.Close()
+
+			if l := ch.Len(); l != tt.wantLen {
+				t.Fatalf("expected length %d, got %d", tt.wantLen, l)
+			}
+
+			if n := ch.AwaitingAck(); n != tt.inFlight {
+				t.Fatalf("expected %d awaiting acknowledgement, got %d", tt.inFlight, n)
+			}
+
+			// Tags stay valid after reopening
+			for i, tag := range tags {
+				if !settled[i] {
+					if err = ch.Ack(tag); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			for _, want := range tt.redeliver {
+				d := readAck(t, ch)
+
+				if d.Data[0] != want {
+					t.Fatalf("expected item %d delivered again, got %d", want, d.Data[0])
+				}
+
+				if err = ch.Ack(d.Tag); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !ch.Empty() {
+				t.Fatalf("expected an empty channel, got length %d", ch.Len())
+			}
+		})
+	}
+}
+
+func TestAckByteChannelVisibilityTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		expire  bool
+	}{
+		{"expired", 10 * time.Millisecond, true},
+		{"not expired", time.Hour, false},
+		{"disabled", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ch")
+			ch, err := NewAckByteChannel(path, 4, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ch.SetVisibilityTimeout(tt.timeout)
+			writeAck(t, ch, 1)
+			readAck(t, ch)
+
+			for i := 0; i < 2; i++ {
+				// The timeout isn't stored, but delivery times are
+				if i > 0 {
+					if err = ch.Close(); err != nil {
+						t.Fatal(err)
+					}
+
+					if ch, err = NewAckByteChannel(path, 4, 1); err != nil {
+						t.Fatal(err)
+					}
+
+					ch.SetVisibilityTimeout(tt.timeout)
+				}
+
+				if !tt.expire {
+					ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+					_, err = ch.WaitCtx(ctx)
+					cancel()
+
+					if err != context.DeadlineExceeded {
+						t.Fatalf("expected no item to read, got %v", err)
+					}
+
+					if n := ch.AwaitingAck(); n != 1 {
+						t.Fatalf("expected 1 awaiting acknowledgement, got %d", n)
+					}
+
+					continue
+				}
+
+				// Waiting readers are woken up when the item expires
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				_, err = ch.WaitCtx(ctx)
+				cancel()
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if d := readAck(t, ch); d.Data[0] != 1 || d.Attempts != uint32(i+2) {
+					t.Fatalf("expected item 1 delivered %d times, got %d delivered %d times", i+2, d.Data[0], d.Attempts)
+				}
+			}
+
+			if err = ch.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestAckByteChannelWriteAt(t *testing.T) {
+	tests := []struct {
+		name        string
+		delays      []time.Duration // Delay of each item, by its value.
+		want        []byte          // Items to read, as they become due.
+		wantDelayed int64
+		wantErr     error // Error of the last WriteAt.
+	}{
+		{"due", []time.Duration{-time.Second, 0}, []byte{0, 1}, 0, nil},
+		{"not due", []time.Duration{time.Hour}, nil, 1, nil},
+		{"due after waiting", []time.Duration{time.Hour, 10 * time.Millisecond}, []byte{1}, 1, nil},
+		{"ordered by due time", []time.Duration{20 * time.Millisecond, 10 * time.Millisecond}, []byte{1, 0}, 0, nil},
+		{"full", []time.Duration{time.Hour, time.Hour, time.Hour}, nil, 2, ErrFull},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ch")
+			ch, err := NewAckByteChannel(path, 4, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = ch.WriteAt(time.Now(), func([]byte) {}); err == nil {
+				t.Fatal("expected error before enabling delays")
+			}
+
+			if err = ch.EnableDelays(2); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, delay := range tt.delays {
+				err = ch.WriteAt(time.Now().Add(delay), func(b []byte) { b[0] = byte(i) })
+
+				if i < len(tt.delays)-1 && err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			// Delayed items survive reopening once delays are enabled again
+			if err = ch.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if ch, err = NewAckByteChannel(path, 4, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			defer ch.Close()
+
+			if err = ch.EnableDelays(2); err != nil {
+				t.Fatal(err)
+			}
+
+			// Waiting readers are woken up when an item is due
+			for _, want := range tt.want {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				_, err = ch.WaitCtx(ctx)
+				cancel()
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if d := readAck(t, ch); d.Data[0] != want {
+					t.Fatalf("expected %d, got %d", want, d.Data[0])
+				}
+			}
+
+			if n := ch.Delayed(); n != tt.wantDelayed {
+				t.Fatalf("expected %d delayed, got %d", tt.wantDelayed, n)
+			}
+
+			if n := ch.Unread(); n != 0 {
+				t.Fatalf("expected nothing more to read, got %d", n)
+			}
+		})
+	}
+}
+
+func TestAckByteChannelReadBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		write    []byte
+		failRead int // Number of items to read and fail before the batch.
+		max      int
+		want     []byte
+		attempts []uint32
+	}{
+		{"all", []byte{1, 2, 3}, 0, 10, []byte{1, 2, 3}, []uint32{1, 1, 1}},
+		{"limited", []byte{1, 2, 3}, 0, 2, []byte{1, 2}, []uint32{1, 1}},
+		{"nacked first", []byte{1, 2}, 1, 10, []byte{1, 2}, []uint32{2, 1}},
+		{"nacked only", []byte{1, 2, 3}, 1, 1, []byte{1}, []uint32{2}},
+		{"failed twice", []byte{1, 2, 3}, 2, 10, []byte{1, 2, 3}, []uint32{3, 1, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ch")
+			ch, err := NewAckByteChannel(path, 4, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writeAck(t, ch, tt.write...)
+
+			for i := 0; i < tt.failRead; i++ {
+				if err := ch.ReadToCallback(func([]byte) error {
+					return errors.New("failed")
+				}, true); err == nil {
+					t.Fatal("expected error")
+				}
+			}
+
+			var got []byte
+			var attempts []uint32
+			var tags []uint64
+
+			if err = ch.ReadBatch(tt.max, func(batch []Delivery) error {
+				for _, d := range batch {
+					got = append(got, d.Data[0])
+					attempts = append(attempts, d.Attempts)
+					tags = append(tags, d.Tag)
+				}
+
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != string(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+
+			for i := range attempts {
+				if attempts[i] != tt.attempts[i] {
+					t.Fatalf("expected attempts %v, got %v", tt.attempts, attempts)
+				}
+			}
+
+			if err = ch.Ack(tags...); err != nil {
+				t.Fatal(err)
+			}
+
+			if l, want := ch.Len(), int64(len(tt.write)-len(tt.want)); l != want {
+				t.Fatalf("expected length %d, got %d", want, l)
+			}
+
+			if err = ch.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if ch, err = NewAckByteChannel(path, 4, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			defer ch.Close()
+
+			if l, want := ch.Len(), int64(len(tt.write)-len(tt.want)); l != want {
+				t.Fatalf("expected length %d after reopening, got %d", want, l)
+			}
+		})
+	}
+}
+
+func TestAckByteChannelReadBatchMax(t *testing.T) {
+	ch, err := NewAckByteChannel(filepath.Join(t.TempDir(), "ch"), 4, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ch.Close()
+
+	writeAck(t, ch, 1)
+
+	for _, max := range []int{0, -1} {
+		if err = ch.ReadBatch(max, func([]Delivery) error { return nil }); err == nil {
+			t.Fatalf("expected error with max %d", max)
+		}
+	}
+
+	if n := ch.Unread(); n != 1 {
+		t.Fatalf("expected 1 unread, got %d", n)
+	}
+}
+
+func TestSharedAckByteChannelOpenWhileCreated(t *testing.T) {
+	tests := []struct {
+		name   string
+		shared bool
+		ok     bool
+	}{
+		{"shared", true, true},
+		{"exclusive", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "ch")
+
+			// A channel with the contents that the creating process will write
+			ch, err := NewAckByteChannel(filepath.Join(dir, "initialized"), 4, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writeAck(t, ch, 1)
+
+			if err = ch.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			initialized, err := os.ReadFile(filepath.Join(dir, "initialized"))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Act as a process that has just created the file
+			f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = flock.Lock(f, true); err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan error, 1)
+
+			go func() {
+				var ch *AckByteChannel
+				var err error
+
+				if tt.shared {
+					ch, err = NewSharedAckByteChannel(path, 4, 1)
+				} else {
+					ch, err = NewAckByteChannel(path, 4, 1)
+				}
+
+				if err == nil {
+					if ch.Len() != 1 {
+						err = errors.New("unexpected length")
+					}
+
+					ch.Close()
+				}
+
+				done <- err
+			}()
+
+			// The opener either waits until the file is initialized, or opens it
+			// afterwards
+			if _, err = f.Write(initialized); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.shared {
+				if err = flock.Lock(f, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = <-done
+			f.Close()
+
+			if (err == nil) != tt.ok {
+				t.Fatalf("expected ok %v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestSharedAckByteChannelConcurrentCreate(t *testing.T) {
+	const openers = 8
+
+	for round := 0; round < 50; round++ {
+		path := filepath.Join(t.TempDir(), "ch")
+		channels := make([]*AckByteChannel, openers)
+		errs := make([]error, openers)
+		start := make(chan struct{})
+
+		var wg sync.WaitGroup
+
+		for i := range channels {
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				channels[i], errs[i] = NewSharedAckByteChannel(path, openers, 1)
+			}(i)
+		}
+
+		close(start)
+		wg.Wait()
+
+		for i, err := range errs {
+			if err != nil {
+				t.Fatalf("opener %d: %v", i, err)
+			}
+
+			writeAck(t, channels[i], byte(i))
+		}
+
+		if l := channels[0].Len(); l != openers {
+			t.Fatalf("expected length %d, got %d", openers, l)
+		}
+
+		for _, ch := range channels {
+			if err := ch.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestAckByteChannelInterruptedAck(t *testing.T) {
+	tests := []struct {
+		name       string
+		offset     int64 // Item whose state is changed without committing.
+		state      uint32
+		wantUnread int64
+		wantRead   byte // Next item to read.
+	}{
+		{"acked", 1, slotAcked, 1, 2},
+		{"nacked", 1, slotNacked, 2, 1},
+		{"not delivered", 2, slotAcked, 1, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ch")
+			ch, err := NewAckByteChannel(path, 4, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writeAck(t, ch, 0, 1, 2)
+			first := readAck(t, ch)
+			readAck(t, ch)
+
+			// A crash after changing the state in place, before the header is
+			// committed
+			ch.slot(ch.index(tt.offset)).state = tt.state
+
+			if err = ch.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if ch, err = NewAckByteChannel(path, 4, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			if n := ch.Unread(); n != tt.wantUnread {
+				t.Fatalf("expected %d unread, got %d", tt.wantUnread, n)
+			}
+
+			d := readAck(t, ch)
+
+			if d.Data[0] != tt.wantRead {
+				t.Fatalf("expected %d, got %d", tt.wantRead, d.Data[0])
+			}
+
+			if err = ch.Ack(first.Tag, d.Tag); err != nil {
+				t.Fatal(err)
+			}
+
+			for ch.Unread() > 0 {
+				if err = ch.Ack(readAck(t, ch).Tag); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ch.AckN(3)
+
+			if !ch.Empty() {
+				t.Fatalf("expected an empty channel, got length %d", ch.Len())
+			}
+
+			// The counters stay valid
+			if err = ch.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if ch, err = NewAckByteChannel(path, 4, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			ch.Close()
+		})
+	}
+}
+
+func TestSharedAckByteChannelTakeOver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ch")
+	producer, err := NewSharedAckByteChannel(path, 4, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer producer.Close()
+
+	consumer, err := NewSharedAckByteChannel(path, 4, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer consumer.Close()
+
+	writeAck(t, producer, 0, 1, 2)
+	first := readAck(t, consumer)
+	readAck(t, consumer)
+
+	// A process that died while holding the lock, after acknowledging the second
+	// item in place
+	consumer.slot(consumer.index(1)).state = slotAcked
+	*(*[2]uint32)(unsafe.Pointer(&consumer.shared.mu)) = [2]uint32{1<<22 + 1, 0}
+
+	if err = producer.Ack(first.Tag); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, n := consumer.Len(), consumer.AwaitingAck(); l != 1 || n != 0 {
+		t.Fatalf("expected length 1 and nothing awaiting acknowledgement, got %d and %d", l, n)
+	}
+}
@@ -8,16 +8,22 @@ import (
 	"sync"
 
 	"github.com/edsrzf/mmap-go"
+	"github.com/webbmaffian/go-mad/internal/flock"
 	"github.com/webbmaffian/go-mad/internal/utils"
 )
 
 type ByteChannel struct {
 	data          mmap.MMap
-	readCond      sync.Cond // Awaited by readers, notified by writers.
-	writeCond     sync.Cond // Awaited by writers, notified by readers.
+	readable      notifier // Awaited by readers, notified by writers.
+	writable      notifier // Awaited by writers, notified by readers.
 	mu            sync.Mutex
 	file          *os.File
-	head          *header
+	head          *header // Working copy of the header, committed to the store after each change.
+	store         headerStore[header]
+	batch         [][]byte     // Reused by ReadBatch.
+	deadLetter    *ByteChannel // Channel that items are moved to after maxAttempts failures, if any.
+	maxAttempts   int64
+	closed        bool
 	closedWriting bool
 }
 
@@ -26,8 +32,7 @@ func NewByteChannel(filepath string, capacity int, itemSize int, allowResize ...
 		head: newHeader(capacity, itemSize),
 	}
 
-	ch.readCond.L = &ch.mu
-	ch.writeCond.L = &ch.mu
+	defer flock.CloseOnError(&err, &ch.file, &ch.data)
 
 	var created bool
 	info, err := os.Stat(filepath)
@@ -37,6 +42,10 @@ func NewByteChannel(filepath string, capacity int, itemSize int, allowResize ...
 			return
 		}
 
+		if err = flock.Lock(ch.file, true); err != nil {
+			return
+		}
+
 		if err = ch.validateHead(info.Size()); err != nil {
 			return
 		}
@@ -49,6 +58,10 @@ func NewByteChannel(filepath string, capacity int, itemSize int, allowResize ...
 			return
 		}
 
+		if err = flock.Lock(ch.file, true); err != nil {
+			return
+		}
+
 		if err = ch.file.Truncate(int64(ch.head.fileSize())); err != nil {
 			return
 		}
@@ -62,19 +75,18 @@ func NewByteChannel(filepath string, capacity int, itemSize int, allowResize ...
 		return
 	}
 
-	if created {
+	ch.store.mapSlots(ch.data)
 
-		if s := int(ch.head.headSize); copy(ch.data[:ch.head.headSize], utils.PointerToBytes(ch.head, s)) != s {
-			return nil, errors.New("failed to write header")
-		}
+	if created {
+		ch.store.init(ch.head)
 
 		if err = ch.Flush(); err != nil {
 			return
 		}
+	} else if !ch.store.load(ch.head) {
+		return nil, errors.New("corrupt header")
 	}
 
-	ch.head = utils.BytesToPointer[header](ch.data[:ch.head.headSize])
-
 	if ch.needResizing(capacity, itemSize) {
 		if allowResize == nil || !allowResize[0] {
 			ch.Close()
@@ -102,6 +114,7 @@ func NewByteChannel(filepath string, capacity int, itemSize int, allowResize ...
 	// Reset statistics
 	ch.head.itemsWritten = 0
 	ch.head.itemsRead = 0
+	ch.commit()
 
 	return
 }
@@ -125,7 +138,23 @@ func (ch *ByteChannel) validateHead(fileSize int64) (err error) {
 		return
 	}
 
-	head := utils.BytesToPointer[header](b)
+	slots := utils.BytesToPointer[headerSlots[header]](b)
+
+	if err = slots[0].head.preamble.Validate(&ch.head.preamble); err != nil {
+		return
+	}
+
+	latest := slots.latest()
+
+	if latest == nil {
+		return errors.New("corrupt header")
+	}
+
+	head := &latest.head
+
+	if head.headSize != ch.head.headSize {
+		return errors.New("invalid header size")
+	}
 
 	if head.itemSize < 1 {
 		return errors.New("invalid item size")
@@ -199,27 +228,36 @@ func (ch *ByteChannel) CopyTo(dst *ByteChannel) {
 	} else {
 		dst.head.length = dst.head.capacity
 	}
+
+	dst.commit()
 }
 
 func (ch *ByteChannel) WriteOrBlock(cb func([]byte)) bool {
+	return ch.WriteCtx(context.Background(), cb) == nil
+}
+
+// Write an item, blocking while the channel is full until the context is done.
+func (ch *ByteChannel) WriteCtx(ctx context.Context, cb func([]byte)) (err error) {
 	ch.mu.Lock()
 	defer ch.mu.Unlock()
 
 	if ch.closedWriting {
-		return false
+		return ErrWritingClosed
 	}
 
 	for !ch.spaceLeft() {
 		if ch.closedWriting {
-			return false
+			return ErrWritingClosed
 		}
 
 		// Wait until there is space in the buffer
-		ch.writeCond.Wait()
+		if err = ch.writable.wait(ctx, &ch.mu); err != nil {
+			return
+		}
 	}
 
 	ch.write(cb)
-	return true
+	return
 }
 
 func (ch *ByteChannel) WriteOrFail(cb func([]byte)) bool {
@@ -254,13 +292,65 @@ func (ch *ByteChannel) write(cb func([]byte)) {
 		ch.head.length++
 	} else {
 		ch.head.startIdx = ch.index(1)
+		ch.head.failures = 0
 	}
 
 	ch.head.itemsWritten++
-	ch.readCond.Broadcast()
+	ch.commit()
+	ch.readable.broadcast()
+}
+
+// Write n items, blocking while the channel is full. As many items as there is
+// space for are written at once, and the callback is called with the index of
+// each item in the batch. Returns the number of items written, which is less
+// than n only if writing is closed.
+func (ch *ByteChannel) WriteBatch(n int, cb func(i int, b []byte)) (written int) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	for written < n {
+		for !ch.spaceLeft() {
+			if ch.closedWriting {
+				return
+			}
+
+			// Wait until there is space in the buffer
+			ch.writable.wait(context.Background(), &ch.mu)
+		}
+
+		if ch.closedWriting {
+			return
+		}
+
+		written += ch.writeBatch(written, n-written, cb)
+	}
+
+	return
+}
+
+// Write up to n items to the free slots, and commit them at once.
+func (ch *ByteChannel) writeBatch(offset int, n int, cb func(i int, b []byte)) int {
+	if free := ch.head.capacity - ch.head.length; int64(n) > free {
+		n = int(free)
+	}
+
+	for i := 0; i < n; i++ {
+		cb(offset+i, ch.slice(ch.index(ch.head.length+int64(i))))
+	}
+
+	ch.head.length += int64(n)
+	ch.head.itemsWritten += uint64(n)
+	ch.commit()
+	ch.readable.broadcast()
+	return n
 }
 
 func (ch *ByteChannel) Wait() (ok bool) {
+	return ch.WaitCtx(context.Background()) == nil
+}
+
+// Wait until there is anything to read, or until the context is done.
+func (ch *ByteChannel) WaitCtx(ctx context.Context) (err error) {
 	ch.mu.Lock()
 	defer ch.mu.Unlock()
 
@@ -269,65 +359,208 @@ func (ch *ByteChannel) Wait() (ok bool) {
 
 		// If writing is closed, there will never be any more to read
 		if ch.closedWriting {
-			return
+			return ErrWritingClosed
 		}
 
-		ch.readCond.Wait()
+		if err = ch.readable.wait(ctx, &ch.mu); err != nil {
+			return
+		}
 	}
 
-	return true
+	return
 }
 
 func (ch *ByteChannel) ReadToCallback(cb func([]byte) error, undoOnError bool) (err error) {
 	ch.mu.Lock()
 	defer ch.mu.Unlock()
 
+	if ch.closed {
+		return ErrClosed
+	}
+
 	// If there is nothing to read, fail
 	if ch.empty() {
 		return ErrEmpty
 	}
 
+	failures := ch.head.failures
 	err = cb(ch.read())
 
 	if undoOnError && err != nil {
+		ch.head.failures = failures + 1
 		ch.undoRead()
-		ch.readCond.Broadcast()
+
+		if ch.moveToDeadLetter(err.Error()) {
+			ch.writable.broadcast()
+		} else {
+			ch.readable.broadcast()
+		}
 	} else {
-		ch.writeCond.Broadcast()
+		ch.writable.broadcast()
 	}
 
 	return
 }
 
-func (ch *ByteChannel) WaitForSync(ctx context.Context) error {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel() // Ensure that the child context is canceled when we're done
+// Move items to a dead-letter channel once reading them has failed
+// maxAttempts times, together with the error of the last failure. The item
+// size of the dead-letter channel must be DeadLetterSize of the item size. If
+// the dead-letter channel is full, items are read again as usual. A nil
+// channel disables dead letters.
+func (ch *ByteChannel) SetDeadLetter(dlq *ByteChannel, maxAttempts int) (err error) {
+	if dlq != nil {
+		if err = validateDeadLetter(dlq, ch.head.itemSize); err != nil {
+			return
+		}
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.deadLetter = dlq
+	ch.maxAttempts = int64(maxAttempts)
+	return
+}
+
+// Move the first item to the dead-letter channel if reading it has failed too
+// many times.
+func (ch *ByteChannel) moveToDeadLetter(reason string) bool {
+	if ch.deadLetter == nil || ch.maxAttempts <= 0 || ch.head.failures < ch.maxAttempts {
+		return false
+	}
+
+	item := ch.slice(ch.index(0))
+
+	if !ch.deadLetter.WriteOrFail(func(b []byte) {
+		writeDeadLetter(b, item, uint32(ch.head.failures), reason)
+	}) {
+		return false
+	}
+
+	ch.read()
+	return true
+}
 
-	// This goroutine waits for the context to be done and then signals the main goroutine.
-	go func() {
-		<-ctx.Done()
-		ch.writeCond.Broadcast() // wake up the main goroutine
-	}()
+// Read up to max items at once. The items are only consumed if the callback
+// returns nil, and the slices are only valid until it returns. An error counts
+// as a failed read of the first item, which might move it to the dead-letter
+// channel.
+func (ch *ByteChannel) ReadBatch(max int, cb func([][]byte) error) (err error) {
+	if max < 1 {
+		return errors.New("max must be at least 1")
+	}
 
 	ch.mu.Lock()
-	for !ch.empty() && ctx.Err() == nil {
-		ch.writeCond.Wait() // wait either for items to be read or for the context to be done
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return ErrClosed
+	}
+
+	// If there is nothing to read, fail
+	if ch.empty() {
+		return ErrEmpty
+	}
+
+	n := ch.head.length
+
+	if int64(max) < n {
+		n = int64(max)
+	}
+
+	ch.batch = ch.batch[:0]
+
+	for i := int64(0); i < n; i++ {
+		ch.batch = append(ch.batch, ch.slice(ch.index(i)))
 	}
-	ch.mu.Unlock()
 
-	// If the context was cancelled or timed out, return its error.
-	return ctx.Err()
+	if err = cb(ch.batch); err != nil {
+		ch.head.failures++
+
+		if ch.moveToDeadLetter(err.Error()) {
+			ch.writable.broadcast()
+		} else {
+			ch.commit()
+		}
+
+		return
+	}
+
+	ch.head.startIdx = ch.index(n)
+	ch.head.length -= n
+	ch.head.itemsRead += uint64(n)
+	ch.head.failures = 0
+	ch.commit()
+	ch.writable.broadcast()
+	return
+}
+
+// Call the callback with the next item without reading it. The slice is only
+// valid until the callback returns.
+func (ch *ByteChannel) Peek(cb func([]byte) error) (err error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return ErrClosed
+	}
+
+	// If there is nothing to read, fail
+	if ch.empty() {
+		return ErrEmpty
+	}
+
+	return cb(ch.slice(ch.index(0)))
+}
+
+// Record the layout of the item type of a typed channel. Fails if the channel
+// was created for another type.
+func (ch *ByteChannel) setFingerprint(fingerprint uint64) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.head.fingerprint != fingerprint {
+		if ch.head.fingerprint != 0 {
+			return errors.New("invalid fingerprint - the layout of the type has changed")
+		}
+
+		ch.head.fingerprint = fingerprint
+		ch.commit()
+	}
+
+	return nil
+}
+
+// Wait until the channel is empty, or until the context is done.
+func (ch *ByteChannel) WaitUntilEmptyCtx(ctx context.Context) (err error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	for !ch.empty() && !ch.closed {
+		if err = ch.writable.wait(ctx, &ch.mu); err != nil {
+			return
+		}
+	}
+
+	if ch.closed {
+		return ErrClosed
+	}
+
+	return
+}
+
+// Same as WaitUntilEmptyCtx.
+func (ch *ByteChannel) WaitForSync(ctx context.Context) error {
+	return ch.WaitUntilEmptyCtx(ctx)
 }
 
 func (ch *ByteChannel) read() []byte {
 	idx := ch.index(0)
+	ch.head.startIdx = ch.index(1)
 	ch.head.length--
 	ch.head.itemsRead++
-
-	if ch.head.length > 0 {
-		ch.head.startIdx = ch.index(1)
-	}
-
+	ch.head.failures = 0
+	ch.commit()
 	return ch.slice(idx)
 }
 
@@ -335,6 +568,11 @@ func (ch *ByteChannel) undoRead() {
 	ch.head.startIdx = ch.index(-1)
 	ch.head.length++
 	ch.head.itemsRead--
+	ch.commit()
+}
+
+func (ch *ByteChannel) commit() {
+	ch.store.commit(ch.head)
 }
 
 func (ch *ByteChannel) Flush() error {
@@ -354,7 +592,8 @@ func (ch *ByteChannel) CloseWriting() {
 
 	if !ch.closedWriting {
 		ch.closedWriting = true
-		ch.writeCond.Broadcast()
+		ch.readable.broadcast()
+		ch.writable.broadcast()
 	}
 }
 
@@ -364,12 +603,24 @@ func (ch *ByteChannel) Close() (err error) {
 	ch.mu.Lock()
 	defer ch.mu.Unlock()
 
+	if ch.closed {
+		return
+	}
+
+	ch.closed = true
 	ch.closedWriting = true
+	ch.readable.broadcast()
+	ch.writable.broadcast()
 
 	if err = ch.flush(); err != nil {
 		return
 	}
 
+	// The mapping must be released for the lock of the file to be released
+	if err = ch.data.Unmap(); err != nil {
+		return
+	}
+
 	return ch.file.Close()
 }
 
@@ -423,7 +674,9 @@ func (ch *ByteChannel) Reset() {
 
 	ch.head.startIdx = 0
 	ch.head.length = 0
-	ch.writeCond.Broadcast()
+	ch.head.failures = 0
+	ch.commit()
+	ch.writable.broadcast()
 }
 
 func (ch *ByteChannel) ItemsWritten() uint64 {
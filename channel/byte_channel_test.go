@@ -0,0 +1,98 @@
+package channel
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+type batchChannel interface {
+	WriteBatch(n int, cb func(i int, b []byte)) (written int)
+	ReadBatch(max int, cb func([][]byte) error) (err error)
+	Len() int64
+}
+
+func TestBatch(t *testing.T) {
+	channels := []struct {
+		name   string
+		open   func(t *testing.T, path string) batchChannel
+		reopen bool
+	}{
+		{"ByteChannel", func(t *testing.T, path string) batchChannel {
+			ch, err := NewByteChannel(path, 4, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			t.Cleanup(func() { ch.Close() })
+			return ch
+		}, true},
+		{"MemoryByteChannel", func(t *testing.T, path string) batchChannel {
+			return NewMemoryByteChannel(4, 1)
+		}, false},
+	}
+
+	tests := []struct {
+		name    string
+		write   int
+		written int
+		max     int
+		read    []byte
+		wantErr bool
+	}{
+		{"all", 3, 3, 10, []byte{0, 1, 2}, false},
+		{"limited", 3, 3, 2, []byte{0, 1}, false},
+		{"zero max", 1, 1, 0, nil, true},
+		{"negative max", 1, 1, -1, nil, true},
+		{"negative write", -1, 0, 1, nil, true},
+	}
+
+	for _, c := range channels {
+		for _, tt := range tests {
+			t.Run(c.name+"/"+tt.name, func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "ch")
+				ch := c.open(t, path)
+
+				if written := ch.WriteBatch(tt.write, func(i int, b []byte) { b[0] = byte(i) }); written != tt.written {
+					t.Fatalf("expected %d written, got %d", tt.written, written)
+				}
+
+				var read []byte
+
+				err := ch.ReadBatch(tt.max, func(batch [][]byte) error {
+					for _, b := range batch {
+						read = append(read, b[0])
+					}
+
+					return nil
+				})
+
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+
+				if string(read) != string(tt.read) {
+					t.Fatalf("expected %v, got %v", tt.read, read)
+				}
+
+				want := int64(tt.written - len(tt.read))
+
+				if l := ch.Len(); l != want {
+					t.Fatalf("expected length %d, got %d", want, l)
+				}
+
+				if !c.reopen {
+					return
+				}
+
+				if err = ch.(*ByteChannel).Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				if l := c.open(t, path).Len(); l != want {
+					t.Fatalf("expected length %d after reopening, got %d", want, l)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package channel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Maximum length of the error text stored with a dead letter. Longer texts are
+// truncated.
+const DeadLetterErrSize = 256
+
+const deadLetterHeadSize = 4 + 2 + DeadLetterErrSize
+
+// An item that has failed too many times, as stored in a dead-letter channel.
+type DeadLetter struct {
+	Item     []byte
+	Attempts uint32
+	Err      string // Reason of the last failure.
+}
+
+// Item size of a dead-letter channel for items of the given size.
+func DeadLetterSize(itemSize int) int {
+	return deadLetterHeadSize + itemSize
+}
+
+// Parse an item read from a dead-letter channel. The item refers to b.
+func ParseDeadLetter(b []byte) (d DeadLetter, err error) {
+	if len(b) < deadLetterHeadSize {
+		return d, errors.New("dead letter too small")
+	}
+
+	errLen := int(binary.LittleEndian.Uint16(b[4:]))
+
+	if errLen > DeadLetterErrSize {
+		return d, errors.New("invalid dead letter")
+	}
+
+	d.Attempts = binary.LittleEndian.Uint32(b)
+	d.Err = string(b[6 : 6+errLen])
+	d.Item = b[deadLetterHeadSize:]
+	return
+}
+
+func writeDeadLetter(b []byte, item []byte, attempts uint32, reason string) {
+	if len(reason) > DeadLetterErrSize {
+		reason = reason[:DeadLetterErrSize]
+	}
+
+	binary.LittleEndian.PutUint32(b, attempts)
+	binary.LittleEndian.PutUint16(b[4:], uint16(len(reason)))
+	copy(b[6:deadLetterHeadSize], reason)
+	copy(b[deadLetterHeadSize:], item)
+}
+
+func validateDeadLetter(dlq *ByteChannel, itemSize int64) error {
+	dlq.mu.Lock()
+	defer dlq.mu.Unlock()
+
+	if expected := int64(DeadLetterSize(int(itemSize))); dlq.head.itemSize != expected {
+		return fmt.Errorf("item size of dead-letter channel must be %d", expected)
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package channel
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeadLetter(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxAttempts int
+		dlqCap      int
+		prefill     int // Number of other dead letters already in the channel.
+		fails       int // Number of failed reads of the item.
+		wantDead    bool
+		wantLen     int64
+	}{
+		{"below max", 3, 2, 0, 2, false, 1},
+		{"reached max", 2, 2, 0, 2, true, 0},
+		{"disabled", 0, 2, 0, 4, false, 1},
+		{"dead-letter channel full", 1, 1, 1, 2, false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "ch")
+			dlqPath := filepath.Join(dir, "dlq")
+			ch, err := NewAckByteChannel(path, 4, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dlq, err := NewByteChannel(dlqPath, tt.dlqCap, DeadLetterSize(1))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = ch.SetDeadLetter(dlq, tt.maxAttempts); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < tt.prefill; i++ {
+				dlq.WriteOrFail(func(b []byte) { writeDeadLetter(b, []byte{0}, 0, "") })
+			}
+
+			writeAck(t, ch, 7)
+
+			for i := 0; i < tt.fails; i++ {
+				if err = ch.ReadToCallback(func([]byte) error {
+					return errors.New("poison")
+				}, true); err == nil {
+					t.Fatal("expected error")
+				}
+			}
+
+			if l := ch.Len(); l != tt.wantLen {
+				t.Fatalf("expected length %d, got %d", tt.wantLen, l)
+			}
+
+			if err = ch.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = dlq.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if ch, err = NewAckByteChannel(path, 4, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			defer ch.Close()
+
+			if dlq, err = NewByteChannel(dlqPath, tt.dlqCap, DeadLetterSize(1)); err != nil {
+				t.Fatal(err)
+			}
+
+			defer dlq.Close()
+
+			if l := ch.Len(); l != tt.wantLen {
+				t.Fatalf("expected length %d after reopening, got %d", tt.wantLen, l)
+			}
+
+			var dead []DeadLetter
+
+			for !dlq.Empty() {
+				if err = dlq.ReadToCallback(func(b []byte) error {
+					d, err := ParseDeadLetter(b)
+
+					if err == nil && d.Attempts > 0 {
+						d.Item = append([]byte(nil), d.Item...)
+						dead = append(dead, d)
+					}
+
+					return err
+				}, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !tt.wantDead {
+				if len(dead) != 0 {
+					t.Fatalf("expected no dead letters, got %v", dead)
+				}
+
+				return
+			}
+
+			if len(dead) != 1 {
+				t.Fatalf("expected 1 dead letter, got %d", len(dead))
+			}
+
+			if d := dead[0]; d.Item[0] != 7 || d.Attempts != uint32(tt.maxAttempts) || d.Err != "poison" {
+				t.Fatalf("unexpected dead letter %+v", d)
+			}
+		})
+	}
+}
+
+func TestDeadLetterSize(t *testing.T) {
+	ch, err := NewAckByteChannel(filepath.Join(t.TempDir(), "ch"), 4, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ch.Close()
+
+	dlq, err := NewByteChannel(filepath.Join(t.TempDir(), "dlq"), 4, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dlq.Close()
+
+	if err = ch.SetDeadLetter(dlq, 1); err == nil {
+		t.Fatal("expected error for wrong item size")
+	}
+}
+
+// Either kind of channel that moves items to a dead-letter channel.
+type batchReader interface {
+	Len() int64
+	Close() error
+}
+
+func TestDeadLetterReadBatch(t *testing.T) {
+	poison := errors.New("poison")
+
+	tests := []struct {
+		name      string
+		open      func(t *testing.T, path string, dlq *ByteChannel) batchReader
+		readBatch func(ch batchReader) error
+		wantDead  []byte
+		wantLen   int64
+	}{
+		{"ack", func(t *testing.T, path string, dlq *ByteChannel) batchReader {
+			ch, err := NewAckByteChannel(path, 4, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = ch.SetDeadLetter(dlq, 2); err != nil {
+				t.Fatal(err)
+			}
+
+			writeAck(t, ch, 7, 8)
+			return ch
+		}, func(ch batchReader) error {
+			return ch.(*AckByteChannel).ReadBatch(2, func([]Delivery) error { return poison })
+		}, []byte{7, 8}, 0},
+		{"byte", func(t *testing.T, path string, dlq *ByteChannel) batchReader {
+			ch, err := NewByteChannel(path, 4, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = ch.SetDeadLetter(dlq, 2); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, v := range []byte{7, 8} {
+				if !ch.WriteOrFail(func(b []byte) { b[0] = v }) {
+					t.Fatalf("failed to write %d", v)
+				}
+			}
+
+			return ch
+		}, func(ch batchReader) error {
+			return ch.(*ByteChannel).ReadBatch(2, func([][]byte) error { return poison })
+		}, []byte{7}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			dlq, err := NewByteChannel(filepath.Join(dir, "dlq"), 4, DeadLetterSize(1))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer dlq.Close()
+
+			ch := tt.open(t, filepath.Join(dir, "ch"), dlq)
+			defer ch.Close()
+
+			for i := 0; i < 2; i++ {
+				if err = tt.readBatch(ch); err != poison {
+					t.Fatalf("expected poison, got %v", err)
+				}
+			}
+
+			if l := ch.Len(); l != tt.wantLen {
+				t.Fatalf("expected length %d, got %d", tt.wantLen, l)
+			}
+
+			var dead []byte
+
+			for !dlq.Empty() {
+				if err = dlq.ReadToCallback(func(b []byte) error {
+					d, err := ParseDeadLetter(b)
+
+					if err == nil {
+						if d.Attempts != 2 || d.Err != "poison" {
+							t.Fatalf("unexpected dead letter %+v", d)
+						}
+
+						dead = append(dead, d.Item[0])
+					}
+
+					return err
+				}, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if string(dead) != string(tt.wantDead) {
+				t.Fatalf("expected dead letters %v, got %v", tt.wantDead, dead)
+			}
+		})
+	}
+}
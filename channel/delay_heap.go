@@ -0,0 +1,331 @@
+package channel
+
+import (
+	"errors"
+	"io"
+	"math"
+	"os"
+	"unsafe"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/webbmaffian/go-mad/internal/flock"
+	"github.com/webbmaffian/go-mad/internal/preamble"
+	"github.com/webbmaffian/go-mad/internal/utils"
+)
+
+// Items that aren't due yet, in a min-heap by due time stored in a file of its
+// own. Each entry is the due time in nanoseconds since the epoch, followed by
+// the item and padded to a multiple of 8 bytes. An entry that is sifted is kept
+// in a scratch entry after the heap, and the other entries are moved into the
+// hole it leaves one at a time. The position of the hole is committed after
+// each move, so an interrupted operation never loses or duplicates an entry -
+// the hole is filled with the scratch entry, and the heap order is restored,
+// when the file is opened again.
+type delayHeap struct {
+	data      mmap.MMap
+	file      *os.File
+	head      *delayHeader
+	store     headerStore[delayHeader]
+	itemSize  int64
+	committed func() // Called after each commit if set, so that tests can inspect interrupted operations.
+}
+
+// Header of a delay heap. The item size is the size of an entry.
+type delayHeader struct {
+	header
+	hole int64 // Position of the hole plus 1, or 0 if the scratch entry isn't in use.
+}
+
+// The entries are followed by the scratch entry.
+func (h delayHeader) fileSize() int64 {
+	return h.headSize + (h.capacity+1)*h.itemSize
+}
+
+func openDelayHeap(filepath string, capacity int, itemSize int64) (h *delayHeap, err error) {
+	entrySize := (8 + itemSize + 7) / 8 * 8
+
+	h = &delayHeap{
+		head: &delayHeader{
+			header: *newHeader(capacity, int(entrySize), preamble.KindDelayHeap),
+		},
+		itemSize: itemSize,
+	}
+
+	h.head.headSize = int64(unsafe.Sizeof(headerSlots[delayHeader]{}))
+
+	defer flock.CloseOnError(&err, &h.file, &h.data)
+
+	var created bool
+	info, err := os.Stat(filepath)
+
+	if err == nil {
+		if h.file, err = os.OpenFile(filepath, os.O_RDWR, 0); err != nil {
+			return
+		}
+
+		if err = flock.Lock(h.file, true); err != nil {
+			return
+		}
+
+		if err = h.validateHead(info.Size()); err != nil {
+			return
+		}
+	} else if os.IsNotExist(err) {
+		if h.head.capacity < 1 {
+			return nil, errors.New("capacity is mandatory")
+		}
+
+		if h.file, err = os.Create(filepath); err != nil {
+			return
+		}
+
+		if err = flock.Lock(h.file, true); err != nil {
+			return
+		}
+
+		if err = h.file.Truncate(int64(h.head.fileSize())); err != nil {
+			return
+		}
+
+		created = true
+	} else {
+		return
+	}
+
+	if h.data, err = mmap.Map(h.file, mmap.RDWR, 0); err != nil {
+		return
+	}
+
+	h.store.mapSlots(h.data)
+
+	if created {
+		h.store.init(h.head)
+
+		if err = h.flush(); err != nil {
+			return
+		}
+	} else if !h.store.load(h.head) {
+		return nil, errors.New("corrupt header")
+	}
+
+	if h.head.capacity != int64(capacity) || h.head.itemSize != entrySize {
+		h.close()
+		return nil, errors.New("capacity and/or item size mismatch")
+	}
+
+	// Fill the hole of an interrupted operation, and restore the heap order
+	if h.head.hole > 0 {
+		h.fill(h.head.hole - 1)
+
+		for i := h.head.length/2 - 1; i >= 0; i-- {
+			copy(h.entry(h.scratch()), h.entry(i))
+			h.down(i)
+		}
+	}
+
+	return
+}
+
+func (h *delayHeap) validateHead(fileSize int64) (err error) {
+	if fileSize < int64(h.head.headSize) {
+		return errors.New("file too small")
+	}
+
+	if _, err = h.file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	b := make([]byte, h.head.headSize)
+
+	if _, err = io.ReadFull(h.file, b); err != nil {
+		return
+	}
+
+	slots := utils.BytesToPointer[headerSlots[delayHeader]](b)
+
+	if err = slots[0].head.preamble.Validate(&h.head.preamble); err != nil {
+		return
+	}
+
+	latest := slots.latest()
+
+	if latest == nil {
+		return errors.New("corrupt header")
+	}
+
+	head := &latest.head
+
+	if head.headSize != h.head.headSize {
+		return errors.New("invalid header size")
+	}
+
+	if head.itemSize < 8 {
+		return errors.New("invalid item size")
+	}
+
+	if head.capacity < 1 || head.length < 0 || head.capacity < head.length {
+		return errors.New("invalid capacity")
+	}
+
+	if head.hole < 0 || head.hole > head.length {
+		return errors.New("invalid hole")
+	}
+
+	if fileSize != head.fileSize() {
+		return errors.New("invalid file size")
+	}
+
+	return
+}
+
+// Add an item that is due at a time. Returns false if the heap is full.
+func (h *delayHeap) push(due int64, cb func([]byte)) bool {
+	if h.head.length >= h.head.capacity {
+		return false
+	}
+
+	*h.due(h.scratch()) = due
+	cb(h.item(h.scratch()))
+	h.head.length++
+	h.up(h.head.length - 1)
+	return true
+}
+
+// The item that is due first, if any.
+func (h *delayHeap) peek() (due int64, item []byte, ok bool) {
+	if h.head.length == 0 {
+		return
+	}
+
+	return *h.due(0), h.item(0), true
+}
+
+// Remove the item that is due first.
+func (h *delayHeap) pop() {
+	h.head.length--
+
+	if h.head.length == 0 {
+		h.commit()
+		return
+	}
+
+	copy(h.entry(h.scratch()), h.entry(h.head.length))
+	h.down(0)
+}
+
+// Time that the first item is due, or math.MaxInt64 if none.
+func (h *delayHeap) next() int64 {
+	if h.head.length == 0 {
+		return math.MaxInt64
+	}
+
+	return *h.due(0)
+}
+
+func (h *delayHeap) len() int64 {
+	return h.head.length
+}
+
+// Sift the scratch entry up from a hole.
+func (h *delayHeap) up(i int64) {
+	h.setHole(i)
+
+	for i > 0 {
+		parent := (i - 1) / 2
+
+		if *h.due(parent) <= *h.due(h.scratch()) {
+			break
+		}
+
+		h.move(parent, i)
+		i = parent
+	}
+
+	h.fill(i)
+}
+
+// Sift the scratch entry down from a hole.
+func (h *delayHeap) down(i int64) {
+	h.setHole(i)
+
+	for {
+		least := h.scratch()
+
+		for _, child := range [2]int64{2*i + 1, 2*i + 2} {
+			if child < h.head.length && *h.due(child) < *h.due(least) {
+				least = child
+			}
+		}
+
+		if least == h.scratch() {
+			break
+		}
+
+		h.move(least, i)
+		i = least
+	}
+
+	h.fill(i)
+}
+
+// Move an entry into the hole, leaving a hole where it was.
+func (h *delayHeap) move(from, hole int64) {
+	copy(h.entry(hole), h.entry(from))
+	h.setHole(from)
+}
+
+func (h *delayHeap) setHole(i int64) {
+	h.head.hole = i + 1
+	h.commit()
+}
+
+// Fill the hole with the scratch entry.
+func (h *delayHeap) fill(hole int64) {
+	copy(h.entry(hole), h.entry(h.scratch()))
+	h.head.hole = 0
+	h.commit()
+}
+
+// Position of the scratch entry.
+func (h *delayHeap) scratch() int64 {
+	return h.head.capacity
+}
+
+func (h *delayHeap) commit() {
+	h.store.commit(h.head)
+
+	if h.committed != nil {
+		h.committed()
+	}
+}
+
+func (h *delayHeap) flush() error {
+	return h.data.Flush()
+}
+
+func (h *delayHeap) close() (err error) {
+	if err = h.flush(); err != nil {
+		return
+	}
+
+	// The mapping must be released for the lock of the file to be released
+	if err = h.data.Unmap(); err != nil {
+		return
+	}
+
+	return h.file.Close()
+}
+
+func (h *delayHeap) entry(index int64) []byte {
+	index *= h.head.itemSize
+	index += h.head.headSize
+	return h.data[index : index+h.head.itemSize]
+}
+
+func (h *delayHeap) due(index int64) *int64 {
+	return utils.BytesToPointer[int64](h.entry(index))
+}
+
+func (h *delayHeap) item(index int64) []byte {
+	return h.entry(index)[8 : 8+h.itemSize]
+}
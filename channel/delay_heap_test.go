@@ -0,0 +1,158 @@
+package channel
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/webbmaffian/go-mad/internal/utils"
+)
+
+func TestDelayHeap(t *testing.T) {
+	tests := []struct {
+		name string
+		dues []int64
+		want []int64
+	}{
+		{"ordered", []int64{1, 2, 3}, []int64{1, 2, 3}},
+		{"reversed", []int64{5, 4, 3, 2, 1}, []int64{1, 2, 3, 4, 5}},
+		{"duplicates", []int64{2, 1, 2, 1}, []int64{1, 1, 2, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "heap")
+			h, err := openDelayHeap(path, 8, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, due := range tt.dues {
+				if !h.push(due, func(b []byte) { b[0] = byte(due) }) {
+					t.Fatal("heap is full")
+				}
+			}
+
+			if err = h.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if h, err = openDelayHeap(path, 8, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			defer h.close()
+
+			if n := h.len(); n != int64(len(tt.want)) {
+				t.Fatalf("expected %d entries after reopening, got %d", len(tt.want), n)
+			}
+
+			for _, want := range tt.want {
+				due, item, ok := h.peek()
+
+				if !ok || due != want || item[0] != byte(want) {
+					t.Fatalf("expected %d, got %d (%v)", want, due, ok)
+				}
+
+				h.pop()
+			}
+
+			if h.next() != math.MaxInt64 {
+				t.Fatal("expected an empty heap")
+			}
+		})
+	}
+}
+
+func TestDelayHeapInterrupted(t *testing.T) {
+	dues := []int64{2, 4, 6, 8, 10, 12, 14}
+
+	tests := []struct {
+		name  string
+		op    func(h *delayHeap)
+		after []int64 // Entries after the operation, or before it if nil.
+	}{
+		{"push", func(h *delayHeap) { h.push(1, func(b []byte) { b[0] = 1 }) }, []int64{1, 2, 4, 6, 8, 10, 12, 14}},
+		{"pop", func(h *delayHeap) { h.pop() }, []int64{4, 6, 8, 10, 12, 14}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			h, err := openDelayHeap(filepath.Join(dir, "heap"), 8, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, due := range dues {
+				h.push(due, func(b []byte) { b[0] = byte(due) })
+			}
+
+			// Keep the file after every commit of the operation, as it would be
+			// after a crash before the next one
+			var files [][]byte
+
+			h.committed = func() {
+				files = append(files, append([]byte(nil), h.data...))
+			}
+
+			tt.op(h)
+
+			if err = h.close(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i, file := range files {
+				head := &utils.BytesToPointer[headerSlots[delayHeader]](file).latest().head
+
+				// The hole might also be partly overwritten by the next move
+				for _, torn := range []bool{false, true} {
+					if torn {
+						if head.hole == 0 {
+							continue
+						}
+
+						pos := head.headSize + (head.hole-1)*head.itemSize
+
+						for j := pos; j < pos+head.itemSize; j++ {
+							file[j] = 0xff
+						}
+					}
+
+					path := filepath.Join(dir, fmt.Sprintf("heap%d-%v", i, torn))
+
+					if err = os.WriteFile(path, file, 0666); err != nil {
+						t.Fatal(err)
+					}
+
+					if h, err = openDelayHeap(path, 8, 1); err != nil {
+						t.Fatal(err)
+					}
+
+					var got []int64
+
+					for due, item, ok := h.peek(); ok; due, item, ok = h.peek() {
+						if item[0] != byte(due) {
+							t.Fatalf("commit %d: entry %d has item %d", i, due, item[0])
+						}
+
+						got = append(got, due)
+						h.pop()
+					}
+
+					if err = h.close(); err != nil {
+						t.Fatal(err)
+					}
+
+					if fmt.Sprint(got) != fmt.Sprint(dues) && fmt.Sprint(got) != fmt.Sprint(tt.after) {
+						t.Fatalf("commit %d (torn %v): expected %v or %v, got %v", i, torn, dues, tt.after, got)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,8 @@
+package channel
+
+// An item read from an acknowledged channel.
+type Delivery struct {
+	Tag      uint64 // Identifies the item when acknowledging or rejecting it.
+	Data     []byte // Only valid until the callback returns.
+	Attempts uint32 // Number of times the item has been delivered, including this time.
+}
@@ -1,5 +1,7 @@
 package channel
 
+import "github.com/webbmaffian/go-mad/internal/flock"
+
 type channelError string
 
 var _ error = channelError("")
@@ -11,3 +13,15 @@ func (err channelError) Error() string {
 const ErrEmpty = channelError("channel is empty")
 const ErrClosed = channelError("channel is closed")
 const ErrWritingClosed = channelError("channel is closed for writing")
+const ErrUnknownTag = channelError("unknown delivery tag")
+const ErrTooLarge = channelError("item is too large")
+const ErrUnknownGroup = channelError("unknown consumer group")
+const ErrRemoved = channelError("item has been removed by retention")
+const ErrOutOfRange = channelError("sequence number out of range")
+const ErrInvalidLane = channelError("invalid priority lane")
+const ErrFull = channelError("channel is full")
+
+// Channel files are locked while open - exclusively when opened for writing,
+// otherwise shared. Opening a file that is locked by another process fails
+// with ErrLocked.
+const ErrLocked = flock.ErrLocked
@@ -0,0 +1,747 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/webbmaffian/go-mad/internal/flock"
+	"github.com/webbmaffian/go-mad/internal/preamble"
+	"github.com/webbmaffian/go-mad/internal/utils"
+)
+
+// Maximum length of the name of a consumer group.
+const GroupNameSize = 48
+
+// What to do when writing to a full channel.
+type LagPolicy uint8
+
+const (
+	// Writers wait until the slowest group has acknowledged the oldest item.
+	LagBlock LagPolicy = iota
+
+	// The slowest groups are dropped to make space. If there are no groups,
+	// the oldest item is dropped.
+	LagDrop
+)
+
+// Offsets of a consumer group, stored after the header. A group with an empty
+// name is unused. The offsets are sequence numbers of items, and are written in
+// place - the header is committed after them, so that items are never released
+// before all groups have acknowledged them.
+type groupState struct {
+	name    [GroupNameSize]byte
+	readSeq uint64 // Sequence number of the next item to read.
+	ackSeq  uint64 // Sequence number of the oldest item that isn't acknowledged.
+}
+
+// Header of a group channel, that stores the consumer group states between the
+// header and the items.
+type groupHeader struct {
+	header
+	groups int64 // Number of consumer group states.
+}
+
+func (h groupHeader) fileSize() int64 {
+	return h.itemsOffset() + h.capacity*h.itemSize
+}
+
+// Offset of the first item in the file.
+func (h groupHeader) itemsOffset() int64 {
+	return h.headSize + h.groups*int64(unsafe.Sizeof(groupState{}))
+}
+
+// A channel that several named consumer groups read independently, each at its
+// own offsets. Items are only released when every group has acknowledged them,
+// so the slowest group holds back writers unless the lag policy is LagDrop.
+type GroupByteChannel struct {
+	data          mmap.MMap
+	readable      notifier // Awaited by readers, notified by writers.
+	writable      notifier // Awaited by writers, notified by readers.
+	mu            sync.Mutex
+	file          *os.File
+	head          *groupHeader // Working copy of the header, committed to the store after each change.
+	store         headerStore[groupHeader]
+	groups        []groupState
+	policy        LagPolicy
+	closed        bool
+	closedWriting bool
+}
+
+// Open or create a channel with space for up to maxGroups consumer groups. If
+// the file already exists, the capacity, item size and max groups must match
+// the values from the file. Items that were read but not acknowledged when the
+// channel was closed are delivered again.
+func NewGroupByteChannel(filepath string, capacity int, itemSize int, maxGroups int) (ch *GroupByteChannel, err error) {
+	if maxGroups < 1 {
+		return nil, errors.New("max groups must be at least 1")
+	}
+
+	ch = &GroupByteChannel{
+		head: &groupHeader{
+			header: *newHeader(capacity, itemSize, preamble.KindGroupChannel),
+			groups: int64(maxGroups),
+		},
+	}
+
+	ch.head.headSize = int64(unsafe.Sizeof(headerSlots[groupHeader]{}))
+
+	defer flock.CloseOnError(&err, &ch.file, &ch.data)
+
+	var created bool
+	info, err := os.Stat(filepath)
+
+	if err == nil {
+		if ch.file, err = os.OpenFile(filepath, os.O_RDWR, 0); err != nil {
+			return
+		}
+
+		if err = flock.Lock(ch.file, true); err != nil {
+			return
+		}
+
+		if err = ch.validateHead(info.Size()); err != nil {
+			return
+		}
+	} else if os.IsNotExist(err) {
+		if ch.head.capacity == 0 {
+			return nil, errors.New("capacity is mandatory")
+		}
+
+		if ch.file, err = os.Create(filepath); err != nil {
+			return
+		}
+
+		if err = flock.Lock(ch.file, true); err != nil {
+			return
+		}
+
+		if err = ch.file.Truncate(int64(ch.head.fileSize())); err != nil {
+			return
+		}
+
+		created = true
+	} else {
+		return
+	}
+
+	if ch.data, err = mmap.Map(ch.file, mmap.RDWR, 0); err != nil {
+		return
+	}
+
+	ch.store.mapSlots(ch.data)
+
+	if created {
+		ch.store.init(ch.head)
+
+		if err = ch.Flush(); err != nil {
+			return
+		}
+	} else if !ch.store.load(ch.head) {
+		return nil, errors.New("corrupt header")
+	}
+
+	if ch.head.capacity != int64(capacity) || ch.head.itemSize != int64(itemSize) || ch.head.groups != int64(maxGroups) {
+		ch.Close()
+		return nil, errors.New("capacity, item size and/or max groups mismatch")
+	}
+
+	ch.groups = utils.BytesToSlice[groupState](ch.data[ch.head.headSize:], maxGroups)
+
+	// Deliver unacknowledged items again, and repair offsets in case of a crash
+	for i := range ch.groups {
+		g := &ch.groups[i]
+
+		if !g.used() {
+			continue
+		}
+
+		if g.ackSeq < ch.head.firstSeq {
+			g.ackSeq = ch.head.firstSeq
+		} else if g.ackSeq > ch.nextSeq() {
+			g.ackSeq = ch.nextSeq()
+		}
+
+		g.readSeq = g.ackSeq
+	}
+
+	// Reset statistics
+	ch.head.itemsWritten = 0
+	ch.head.itemsRead = 0
+	ch.release()
+
+	return
+}
+
+func (ch *GroupByteChannel) validateHead(fileSize int64) (err error) {
+	if fileSize < int64(ch.head.headSize) {
+		return errors.New("file too small")
+	}
+
+	if ch.file == nil {
+		return errors.New("file is not open")
+	}
+
+	if _, err = ch.file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	b := make([]byte, ch.head.headSize)
+
+	if _, err = io.ReadFull(ch.file, b); err != nil {
+		return
+	}
+
+	slots := utils.BytesToPointer[headerSlots[groupHeader]](b)
+
+	if err = slots[0].head.preamble.Validate(&ch.head.preamble); err != nil {
+		return
+	}
+
+	latest := slots.latest()
+
+	if latest == nil {
+		return errors.New("corrupt header")
+	}
+
+	head := &latest.head
+
+	if head.headSize != ch.head.headSize {
+		return errors.New("invalid header size")
+	}
+
+	if head.itemSize < 1 {
+		return errors.New("invalid item size")
+	}
+
+	if head.groups < 1 {
+		return errors.New("invalid max groups")
+	}
+
+	// Start index must be less than capacity
+	if head.startIdx >= head.capacity {
+		return errors.New("invalid capacity")
+	}
+
+	// A capacity can never be less than the length
+	if head.capacity < head.length {
+		return errors.New("invalid capacity")
+	}
+
+	if fileSize != head.fileSize() {
+		return errors.New("invalid file size")
+	}
+
+	return
+}
+
+// Set what to do when writing to a full channel. Defaults to LagBlock.
+func (ch *GroupByteChannel) SetLagPolicy(policy LagPolicy) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.policy = policy
+	ch.writable.broadcast()
+}
+
+// Join a consumer group, or create it if it doesn't exist. A new group starts
+// at the oldest item in the channel. Names can't contain NUL bytes.
+func (ch *GroupByteChannel) Group(name string) (g *ConsumerGroup, err error) {
+	if name == "" || len(name) > GroupNameSize || strings.IndexByte(name, 0) >= 0 {
+		return nil, errors.New("invalid group name")
+	}
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return nil, ErrClosed
+	}
+
+	free := -1
+
+	for i := range ch.groups {
+		if ch.groups[i].is(name) {
+			return &ConsumerGroup{ch: ch, idx: i, name: name}, nil
+		}
+
+		if free < 0 && !ch.groups[i].used() {
+			free = i
+		}
+	}
+
+	if free < 0 {
+		return nil, errors.New("too many consumer groups")
+	}
+
+	state := &ch.groups[free]
+	state.readSeq = ch.head.firstSeq
+	state.ackSeq = ch.head.firstSeq
+	copy(state.name[:], name)
+
+	return &ConsumerGroup{ch: ch, idx: free, name: name}, nil
+}
+
+// Remove a consumer group, releasing the items it hasn't acknowledged.
+func (ch *GroupByteChannel) RemoveGroup(name string) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return ErrClosed
+	}
+
+	for i := range ch.groups {
+		if ch.groups[i].is(name) {
+			ch.groups[i] = groupState{}
+			ch.release()
+			return nil
+		}
+	}
+
+	return ErrUnknownGroup
+}
+
+// Names of all consumer groups.
+func (ch *GroupByteChannel) Groups() (names []string) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return
+	}
+
+	for i := range ch.groups {
+		if ch.groups[i].used() {
+			names = append(names, ch.groups[i].nameString())
+		}
+	}
+
+	return
+}
+
+func (ch *GroupByteChannel) WriteOrBlock(cb func([]byte)) bool {
+	return ch.WriteCtx(context.Background(), cb) == nil
+}
+
+// Write an item, blocking while the channel is full until the context is done.
+// With LagDrop, the slowest groups are dropped instead of blocking.
+func (ch *GroupByteChannel) WriteCtx(ctx context.Context, cb func([]byte)) (err error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closedWriting {
+		return ErrWritingClosed
+	}
+
+	for !ch.spaceLeft() {
+		if ch.closedWriting {
+			return ErrWritingClosed
+		}
+
+		if ch.policy == LagDrop {
+			ch.dropLagging()
+			continue
+		}
+
+		// Wait until there is space in the buffer
+		if err = ch.writable.wait(ctx, &ch.mu); err != nil {
+			return
+		}
+	}
+
+	ch.write(cb)
+	return
+}
+
+// Write an item, unless the channel is full. With LagDrop, the slowest groups
+// are dropped instead of failing.
+func (ch *GroupByteChannel) WriteOrFail(cb func([]byte)) bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closedWriting {
+		return false
+	}
+
+	for !ch.spaceLeft() {
+		if ch.policy != LagDrop {
+			return false
+		}
+
+		ch.dropLagging()
+	}
+
+	ch.write(cb)
+	return true
+}
+
+func (ch *GroupByteChannel) write(cb func([]byte)) {
+	cb(ch.slice(ch.index(ch.head.length)))
+	ch.head.length++
+	ch.head.itemsWritten++
+	ch.commit()
+	ch.readable.broadcast()
+}
+
+// Drop the groups holding back the oldest item, or the oldest item itself if
+// there are no groups.
+func (ch *GroupByteChannel) dropLagging() {
+	var dropped bool
+
+	for i := range ch.groups {
+		if g := &ch.groups[i]; g.used() && g.ackSeq == ch.head.firstSeq {
+			*g = groupState{}
+			dropped = true
+		}
+	}
+
+	if !dropped {
+		ch.remove(1)
+	}
+
+	ch.release()
+}
+
+// Release the items that all groups have acknowledged, and commit.
+func (ch *GroupByteChannel) release() {
+	var found bool
+	minSeq := ch.nextSeq()
+
+	for i := range ch.groups {
+		if g := &ch.groups[i]; g.used() {
+			found = true
+
+			if g.ackSeq < minSeq {
+				minSeq = g.ackSeq
+			}
+		}
+	}
+
+	// Without any groups, items are kept for groups to come
+	if found && minSeq > ch.head.firstSeq {
+		ch.remove(int64(minSeq - ch.head.firstSeq))
+		ch.writable.broadcast()
+	}
+
+	ch.commit()
+}
+
+// Remove items from the start without committing.
+func (ch *GroupByteChannel) remove(n int64) {
+	ch.head.startIdx = ch.index(n)
+	ch.head.length -= n
+	ch.head.firstSeq += uint64(n)
+}
+
+// Sequence number of the next item to write.
+func (ch *GroupByteChannel) nextSeq() uint64 {
+	return ch.head.firstSeq + uint64(ch.head.length)
+}
+
+func (ch *GroupByteChannel) commit() {
+	ch.store.commit(ch.head)
+}
+
+func (ch *GroupByteChannel) Flush() error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.flush()
+}
+
+func (ch *GroupByteChannel) flush() error {
+	return ch.data.Flush()
+}
+
+func (ch *GroupByteChannel) CloseWriting() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if !ch.closedWriting {
+		ch.closedWriting = true
+		ch.readable.broadcast()
+		ch.writable.broadcast()
+	}
+}
+
+func (ch *GroupByteChannel) Close() (err error) {
+	ch.CloseWriting()
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return
+	}
+
+	ch.closed = true
+	ch.closedWriting = true
+	ch.readable.broadcast()
+	ch.writable.broadcast()
+
+	if err = ch.flush(); err != nil {
+		return
+	}
+
+	// The mapping must be released for the lock of the file to be released
+	if err = ch.data.Unmap(); err != nil {
+		return
+	}
+
+	return ch.file.Close()
+}
+
+func (ch *GroupByteChannel) SpaceLeft() bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.spaceLeft()
+}
+
+func (ch *GroupByteChannel) spaceLeft() bool {
+	return ch.head.length < ch.head.capacity
+}
+
+// Number of items that some group hasn't acknowledged yet.
+func (ch *GroupByteChannel) Len() int64 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.head.length
+}
+
+func (ch *GroupByteChannel) Cap() int64 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.head.capacity
+}
+
+func (ch *GroupByteChannel) ItemsWritten() uint64 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.head.itemsWritten
+}
+
+func (ch *GroupByteChannel) slice(index int64) []byte {
+	index *= ch.head.itemSize
+	index += ch.head.itemsOffset()
+	return ch.data[index : index+ch.head.itemSize]
+}
+
+func (ch *GroupByteChannel) index(index int64) int64 {
+	return ch.wrap(ch.head.startIdx + index)
+}
+
+func (ch *GroupByteChannel) wrap(index int64) int64 {
+	return (index + ch.head.capacity) % ch.head.capacity
+}
+
+func (s *groupState) used() bool {
+	return s.name[0] != 0
+}
+
+func (s *groupState) is(name string) bool {
+	return s.used() && s.nameString() == name
+}
+
+func (s *groupState) nameString() string {
+	n := 0
+
+	for n < len(s.name) && s.name[n] != 0 {
+		n++
+	}
+
+	return string(s.name[:n])
+}
+
+// A consumer group of a GroupByteChannel. Every group reads all items, and
+// acknowledges them in order.
+type ConsumerGroup struct {
+	ch   *GroupByteChannel
+	idx  int
+	name string
+}
+
+func (g *ConsumerGroup) Name() string {
+	return g.name
+}
+
+// State of the group. Fails if the channel is closed, or if the group has been
+// removed or dropped for lagging.
+func (g *ConsumerGroup) state() (*groupState, error) {
+	if g.ch.closed {
+		return nil, ErrClosed
+	}
+
+	if s := &g.ch.groups[g.idx]; s.is(g.name) {
+		return s, nil
+	}
+
+	return nil, ErrUnknownGroup
+}
+
+func (g *ConsumerGroup) Wait() (ok bool) {
+	return g.WaitCtx(context.Background()) == nil
+}
+
+// Wait until there is anything for the group to read, or until the context is
+// done.
+func (g *ConsumerGroup) WaitCtx(ctx context.Context) (err error) {
+	ch := g.ch
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	var s *groupState
+
+	for {
+		if s, err = g.state(); err != nil {
+			return
+		}
+
+		if s.readSeq < ch.nextSeq() {
+			return
+		}
+
+		// If writing is closed, there will never be any more to read
+		if ch.closedWriting {
+			return ErrWritingClosed
+		}
+
+		if err = ch.readable.wait(ctx, &ch.mu); err != nil {
+			return
+		}
+	}
+}
+
+// Read the next item of the group. The item must be acknowledged once handled.
+func (g *ConsumerGroup) ReadToCallback(cb func([]byte) error, undoOnError bool) (err error) {
+	ch := g.ch
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	s, err := g.state()
+
+	if err != nil {
+		return
+	}
+
+	// If there is nothing to read, fail
+	if s.readSeq >= ch.nextSeq() {
+		return ErrEmpty
+	}
+
+	seq := s.readSeq
+	s.readSeq++
+	ch.head.itemsRead++
+
+	if err = cb(ch.slice(ch.index(int64(seq - ch.head.firstSeq)))); err != nil && undoOnError {
+		s.readSeq = seq
+		ch.head.itemsRead--
+	}
+
+	return
+}
+
+// Acknowledge all items that the group has read.
+func (g *ConsumerGroup) Ack() (err error) {
+	ch := g.ch
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	s, err := g.state()
+
+	if err != nil {
+		return
+	}
+
+	s.ackSeq = s.readSeq
+	ch.release()
+	return
+}
+
+// Acknowledge up to n of the oldest items that the group has read. Returns the
+// number of acknowledged items.
+func (g *ConsumerGroup) AckN(n int) (acked int) {
+	if n < 1 {
+		return
+	}
+
+	ch := g.ch
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	s, err := g.state()
+
+	if err != nil {
+		return
+	}
+
+	if inFlight := s.readSeq - s.ackSeq; uint64(n) > inFlight {
+		n = int(inFlight)
+	}
+
+	s.ackSeq += uint64(n)
+	ch.release()
+	return n
+}
+
+// Read all unacknowledged items of the group again. Returns the number of
+// items that will be read again.
+func (g *ConsumerGroup) Rewind() (count int64) {
+	ch := g.ch
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	s, err := g.state()
+
+	if err != nil {
+		return
+	}
+
+	count = int64(s.readSeq - s.ackSeq)
+	s.readSeq = s.ackSeq
+
+	if count > 0 {
+		ch.readable.broadcast()
+	}
+
+	return
+}
+
+// Number of items that the group hasn't read.
+func (g *ConsumerGroup) Unread() int64 {
+	ch := g.ch
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	s, err := g.state()
+
+	if err != nil {
+		return 0
+	}
+
+	return int64(ch.nextSeq() - s.readSeq)
+}
+
+// Number of items that the group has read but not acknowledged.
+func (g *ConsumerGroup) AwaitingAck() int64 {
+	ch := g.ch
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	s, err := g.state()
+
+	if err != nil {
+		return 0
+	}
+
+	return int64(s.readSeq - s.ackSeq)
+}
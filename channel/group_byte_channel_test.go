@@ -0,0 +1,167 @@
+package channel
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestGroupByteChannelWriteOrFail(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  LagPolicy
+		groups  []string
+		writes  int
+		wantOk  []bool
+		wantLen int64
+		wantGrp []string
+	}{
+		{"block", LagBlock, []string{"a"}, 3, []bool{true, true, false}, 2, []string{"a"}},
+		{"drop lagging group", LagDrop, []string{"a"}, 3, []bool{true, true, true}, 2, nil},
+		{"drop without groups", LagDrop, nil, 3, []bool{true, true, true}, 2, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ch")
+			ch, err := NewGroupByteChannel(path, 2, 1, 4)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ch.SetLagPolicy(tt.policy)
+
+			for _, name := range tt.groups {
+				if _, err = ch.Group(name); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i := 0; i < tt.writes; i++ {
+				if ok := ch.WriteOrFail(func(b []byte) { b[0] = byte(i) }); ok != tt.wantOk[i] {
+					t.Fatalf("write %d: expected %v, got %v", i, tt.wantOk[i], ok)
+				}
+			}
+
+			if l := ch.Len(); l != tt.wantLen || l > ch.Cap() {
+				t.Fatalf("expected length %d, got %d", tt.wantLen, l)
+			}
+
+			if err = ch.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if ch, err = NewGroupByteChannel(path, 2, 1, 4); err != nil {
+				t.Fatal(err)
+			}
+
+			defer ch.Close()
+
+			if l := ch.Len(); l != tt.wantLen {
+				t.Fatalf("expected length %d after reopening, got %d", tt.wantLen, l)
+			}
+
+			if groups := ch.Groups(); len(groups) != len(tt.wantGrp) {
+				t.Fatalf("expected groups %v, got %v", tt.wantGrp, groups)
+			}
+		})
+	}
+}
+
+func TestGroupByteChannelGroupName(t *testing.T) {
+	tests := []struct {
+		name  string
+		group string
+		ok    bool
+	}{
+		{"valid", "workers", true},
+		{"empty", "", false},
+		{"too long", string(make([]byte, GroupNameSize+1)), false},
+		{"nul", "a\x00b", false},
+	}
+
+	ch, err := NewGroupByteChannel(filepath.Join(t.TempDir(), "ch"), 2, 1, 4)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ch.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ch.Group(tt.group); (err == nil) != tt.ok {
+				t.Fatalf("expected ok %v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestConsumerGroupAckN(t *testing.T) {
+	tests := []struct {
+		name    string
+		read    int
+		n       int
+		want    int
+		wantLen int64
+	}{
+		{"some", 3, 2, 2, 2},
+		{"more than read", 2, 5, 2, 2},
+		{"zero", 3, 0, 0, 4},
+		{"negative", 3, -1, 0, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ch")
+			ch, err := NewGroupByteChannel(path, 4, 1, 4)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			g, err := ch.Group("a")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 4; i++ {
+				ch.WriteOrFail(func(b []byte) { b[0] = byte(i) })
+			}
+
+			for i := 0; i < tt.read; i++ {
+				if err = g.ReadToCallback(func([]byte) error { return nil }, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if acked := g.AckN(tt.n); acked != tt.want {
+				t.Fatalf("expected %d acked, got %d", tt.want, acked)
+			}
+
+			if l := ch.Len(); l != tt.wantLen {
+				t.Fatalf("expected length %d, got %d", tt.wantLen, l)
+			}
+
+			if err = ch.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if ch, err = NewGroupByteChannel(path, 4, 1, 4); err != nil {
+				t.Fatal(err)
+			}
+
+			defer ch.Close()
+
+			if g, err = ch.Group("a"); err != nil {
+				t.Fatal(err)
+			}
+
+			// Unacknowledged items are read again
+			if l, want := g.Unread(), tt.wantLen; l != want {
+				t.Fatalf("expected %d unread after reopening, got %d", want, l)
+			}
+		})
+	}
+}
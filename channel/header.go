@@ -1,20 +1,32 @@
 package channel
 
 import (
+	"hash/crc32"
 	"unsafe"
+
+	"github.com/webbmaffian/go-mad/internal/preamble"
+	"github.com/webbmaffian/go-mad/internal/utils"
 )
 
-func newHeader(capacity int, itemSize int) *header {
+func newHeader(capacity int, itemSize int, kind ...preamble.Kind) *header {
 	h := &header{
+		preamble: preamble.New(preamble.KindChannel),
 		capacity: int64(capacity),
 		itemSize: int64(itemSize),
 	}
-	h.headSize = int64(unsafe.Sizeof(*h))
+	h.headSize = int64(unsafe.Sizeof(headerSlots[header]{}))
+
+	if kind != nil {
+		h.preamble = preamble.New(kind[0])
+	}
 
 	return h
 }
 
+// Header common to all kinds of files. Kinds that need more state have their
+// own header type, that embeds this one.
 type header struct {
+	preamble     preamble.Preamble
 	headSize     int64
 	itemSize     int64
 	startIdx     int64
@@ -23,8 +35,118 @@ type header struct {
 	capacity     int64
 	itemsWritten uint64
 	itemsRead    uint64
+	fingerprint  uint64 // Layout of the item type of a typed channel, or 0 if untyped.
+	slotSize     int64  // Size of the state stored per item, or 0 if none.
+	firstSeq     uint64 // Sequence number of the first item, used as its delivery tag.
+	acked        int64  // Acknowledged items that are still awaiting, as earlier items aren't.
+	nacked       int64  // Awaiting items that are to be delivered again.
+	failures     int64  // Failed reads of the first item, in a channel without acknowledgements.
 }
 
 func (h header) fileSize() int64 {
-	return h.headSize + h.capacity*h.itemSize
+	return h.headSize + h.capacity*(h.itemSize+h.slotSize)
+}
+
+// Number of items to read, including items to deliver again.
+func (h header) unread() int64 {
+	return h.length - h.awaitingAck + h.nacked
+}
+
+// Number of read items that are neither acknowledged nor to be delivered again.
+func (h header) inFlight() int64 {
+	return h.awaitingAck - h.acked - h.nacked
+}
+
+const (
+	slotDelivered uint32 = iota // Also the state of unread items.
+	slotAcked
+	slotNacked
+)
+
+// State of an item in an acknowledged channel. The states are stored after
+// the items, in the same order.
+type slotState struct {
+	state       uint32
+	attempts    uint32 // Number of times the item has been delivered.
+	deliveredAt int64  // Time of the last delivery, in nanoseconds since the epoch.
+}
+
+// A copy of the header of a kind of file, of type H.
+type headerSlot[H any] struct {
+	head     H
+	seq      uint64
+	checksum uint32
+}
+
+func (s *headerSlot[H]) valid() bool {
+	return s.checksum == s.sum()
+}
+
+func (s *headerSlot[H]) sum() uint32 {
+	return crc32.ChecksumIEEE(utils.PointerToBytes(s, int(unsafe.Offsetof(s.checksum))))
+}
+
+// The header is stored twice at the start of the file, and the copies are
+// written alternately with an increasing sequence number and a checksum. If a
+// write is interrupted, the other copy is still intact.
+type headerSlots[H any] [2]headerSlot[H]
+
+// Returns the last completely written copy, or nil if none is valid.
+func (s *headerSlots[H]) latest() (latest *headerSlot[H]) {
+	for i := range s {
+		if s[i].valid() && (latest == nil || s[i].seq > latest.seq) {
+			latest = &s[i]
+		}
+	}
+
+	return
+}
+
+type headerStore[H any] struct {
+	slots *headerSlots[H]
+	seq   uint64
+}
+
+func (s *headerStore[H]) mapSlots(data []byte) {
+	s.slots = utils.BytesToPointer[headerSlots[H]](data[:unsafe.Sizeof(headerSlots[H]{})])
+}
+
+// Load the last completely written copy of the header into h. Returns false if
+// no copy is valid.
+func (s *headerStore[H]) load(h *H) bool {
+	var latest headerSlot[H]
+	var found bool
+
+	for i := range s.slots {
+		// Copy before validating, as another process might be writing to it
+		slot := s.slots[i]
+
+		if slot.valid() && (!found || slot.seq > latest.seq) {
+			latest, found = slot, true
+		}
+	}
+
+	if !found {
+		return false
+	}
+
+	*h = latest.head
+	s.seq = latest.seq
+	return true
+}
+
+// Write the header to both copies of a new file.
+func (s *headerStore[H]) init(h *H) {
+	s.commit(h)
+	s.commit(h)
+}
+
+// Write the header to the oldest copy. Everything the header refers to must be
+// written before, so that a crash never exposes unwritten data.
+func (s *headerStore[H]) commit(h *H) {
+	s.seq++
+	slot := &s.slots[s.seq%2]
+	slot.head = *h
+	slot.seq = s.seq
+	slot.checksum = slot.sum()
 }
@@ -0,0 +1,672 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/webbmaffian/go-mad/internal/flock"
+	"github.com/webbmaffian/go-mad/internal/preamble"
+	"github.com/webbmaffian/go-mad/internal/utils"
+)
+
+const logSegmentExt = ".seg"
+
+type LogOptions struct {
+	// Number of items per segment file. Mandatory. Existing segments keep the
+	// size they were created with.
+	SegmentSize int
+
+	// Segments whose last item is older than this are deleted by Retain. Zero
+	// means no age limit.
+	MaxAge time.Duration
+
+	// The oldest segments are deleted by Retain while the total size of all
+	// segment files exceeds this. Zero means no size limit.
+	MaxBytes int64
+}
+
+// A durable, append-only stream of items, stored in a directory of numbered
+// segment files. Every item gets a sequence number, and readers can start at
+// any retained sequence number. Items are never overwritten - once a segment
+// is full, a new one is created, and the oldest segments are deleted according
+// to the retention options. The active segment is never deleted.
+type Log struct {
+	readable notifier // Awaited by readers, notified by writers.
+	mu       sync.Mutex
+	dir      string
+	itemSize int64
+	opt      LogOptions
+	segments []*logSegment // Ordered by sequence number, the last being the active one.
+	closed   bool
+}
+
+// Header of a log segment.
+type segmentHeader struct {
+	header
+	writtenAt int64 // Time of the last write, in nanoseconds since the epoch.
+}
+
+func newSegmentHeader(capacity int, itemSize int64) *segmentHeader {
+	h := &segmentHeader{
+		header: *newHeader(capacity, int(itemSize), preamble.KindLogSegment),
+	}
+	h.headSize = int64(unsafe.Sizeof(headerSlots[segmentHeader]{}))
+
+	return h
+}
+
+// A segment file of a log. The header's firstSeq is the sequence number of its
+// first item.
+type logSegment struct {
+	data  mmap.MMap
+	file  *os.File
+	path  string
+	size  int64
+	head  *segmentHeader // Working copy of the header, committed to the store after each change.
+	store headerStore[segmentHeader]
+}
+
+// Open or create a log in a directory, which is created if needed. All
+// existing segments must have the item size.
+func NewLog(dir string, itemSize int, opt LogOptions) (l *Log, err error) {
+	if itemSize < 1 {
+		return nil, errors.New("item must be at least 1 byte")
+	}
+
+	if opt.SegmentSize < 1 {
+		return nil, errors.New("segment size is mandatory")
+	}
+
+	if err = os.MkdirAll(dir, 0777); err != nil {
+		return
+	}
+
+	l = &Log{
+		dir:      dir,
+		itemSize: int64(itemSize),
+		opt:      opt,
+	}
+
+	defer func() {
+		if err != nil {
+			l.close()
+			l = nil
+		}
+	}()
+
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return
+	}
+
+	var paths []string
+
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), logSegmentExt) {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+
+	for i, path := range paths {
+		// The last segment might have been left uninitialized by an interrupted
+		// roll, in which case it's created again once needed
+		if i == len(paths)-1 {
+			var removed bool
+
+			if removed, err = removeUninitializedLogSegment(path); err != nil {
+				return
+			} else if removed {
+				continue
+			}
+		}
+
+		var seg *logSegment
+
+		if seg, err = openLogSegment(path, int64(itemSize)); err != nil {
+			return
+		}
+
+		l.segments = append(l.segments, seg)
+	}
+
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].head.firstSeq < l.segments[j].head.firstSeq
+	})
+
+	for i := 1; i < len(l.segments); i++ {
+		if prev := l.segments[i-1]; prev.nextSeq() != l.segments[i].head.firstSeq {
+			err = fmt.Errorf("gap in log before segment %s", l.segments[i].path)
+			return
+		}
+	}
+
+	if l.segments == nil {
+		if err = l.roll(0); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Append an item, and return its sequence number.
+func (l *Log) Append(cb func([]byte)) (seq uint64, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	seg := l.active()
+
+	if seg.full() {
+		if err = seg.flush(); err != nil {
+			return
+		}
+
+		if err = l.roll(seg.nextSeq()); err != nil {
+			return
+		}
+
+		if err = l.retain(); err != nil {
+			return
+		}
+
+		seg = l.active()
+	}
+
+	seq = seg.nextSeq()
+	cb(seg.slice(seg.head.length))
+	seg.head.length++
+	seg.head.itemsWritten++
+	seg.head.writtenAt = time.Now().UnixNano()
+	seg.commit()
+	l.readable.broadcast()
+	return
+}
+
+// Create a new active segment starting at a sequence number.
+func (l *Log) roll(firstSeq uint64) (err error) {
+	path := filepath.Join(l.dir, logSegmentName(firstSeq))
+	seg, err := createLogSegment(path, l.opt.SegmentSize, l.itemSize, firstSeq)
+
+	if err != nil {
+		return
+	}
+
+	l.segments = append(l.segments, seg)
+	return
+}
+
+// Delete the oldest segments according to the retention options. This is done
+// automatically whenever a new segment is created, but should also be called
+// periodically if MaxAge is set.
+func (l *Log) Retain() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	return l.retain()
+}
+
+func (l *Log) retain() (err error) {
+	var total int64
+
+	for _, seg := range l.segments {
+		total += seg.size
+	}
+
+	now := time.Now().UnixNano()
+
+	for len(l.segments) > 1 {
+		seg := l.segments[0]
+		expired := l.opt.MaxAge > 0 && now-seg.head.writtenAt > int64(l.opt.MaxAge)
+		oversized := l.opt.MaxBytes > 0 && total > l.opt.MaxBytes
+
+		if !expired && !oversized {
+			break
+		}
+
+		// The segment is gone once closed, even if the file can't be removed
+		total -= seg.size
+		l.segments[0] = nil
+		l.segments = l.segments[1:]
+
+		if err = seg.close(); err != nil {
+			return
+		}
+
+		if err = os.Remove(seg.path); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Create a reader starting at a sequence number.
+func (l *Log) NewReader(seq uint64) (r *LogReader, err error) {
+	r = &LogReader{log: l}
+
+	if err = r.Seek(seq); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Sequence number of the oldest retained item.
+func (l *Log) FirstSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.firstSeq()
+}
+
+func (l *Log) firstSeq() uint64 {
+	if l.closed {
+		return 0
+	}
+
+	return l.segments[0].head.firstSeq
+}
+
+// Sequence number of the next item to append.
+func (l *Log) NextSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.nextSeq()
+}
+
+func (l *Log) nextSeq() uint64 {
+	if l.closed {
+		return 0
+	}
+
+	return l.active().nextSeq()
+}
+
+// Number of segment files.
+func (l *Log) Segments() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.segments)
+}
+
+func (l *Log) active() *logSegment {
+	return l.segments[len(l.segments)-1]
+}
+
+// Segment containing an item. The sequence number must be retained.
+func (l *Log) segment(seq uint64) *logSegment {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].head.firstSeq > seq
+	})
+
+	return l.segments[i-1]
+}
+
+func (l *Log) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	return l.active().flush()
+}
+
+// Close the log. Readers waiting for items are woken up.
+func (l *Log) Close() (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return
+	}
+
+	l.readable.broadcast()
+	return l.close()
+}
+
+func (l *Log) close() (err error) {
+	l.closed = true
+
+	for _, seg := range l.segments {
+		if e := seg.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	l.segments = nil
+	return
+}
+
+// A reader of a log, at its own position. A reader must only be used by one
+// goroutine at a time.
+type LogReader struct {
+	log *Log
+	seq uint64 // Sequence number of the next item to read.
+}
+
+// Move to a sequence number. Fails with ErrRemoved if the item has been
+// removed by retention, and with ErrOutOfRange if it hasn't been appended yet.
+// Seeking to the next sequence number to append is allowed.
+func (r *LogReader) Seek(seq uint64) error {
+	l := r.log
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	if seq < l.firstSeq() {
+		return ErrRemoved
+	}
+
+	if seq > l.nextSeq() {
+		return ErrOutOfRange
+	}
+
+	r.seq = seq
+	return nil
+}
+
+// Sequence number of the next item to read.
+func (r *LogReader) Seq() uint64 {
+	return r.seq
+}
+
+func (r *LogReader) Wait() (ok bool) {
+	return r.WaitCtx(context.Background()) == nil
+}
+
+// Wait until there is anything to read, or until the context is done.
+func (r *LogReader) WaitCtx(ctx context.Context) (err error) {
+	l := r.log
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for !l.closed && r.seq >= l.nextSeq() {
+		if err = l.readable.wait(ctx, &l.mu); err != nil {
+			return
+		}
+	}
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	return
+}
+
+// Read the next item together with its sequence number. The reader only moves
+// past the item if the callback returns nil, or if undoOnError is false. Fails
+// with ErrRemoved if the next item has been removed by retention - seek to
+// FirstSeq to continue with the oldest retained item.
+func (r *LogReader) ReadToCallback(cb func(seq uint64, b []byte) error, undoOnError bool) (err error) {
+	l := r.log
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+
+	if r.seq < l.firstSeq() {
+		return ErrRemoved
+	}
+
+	// If there is nothing to read, fail
+	if r.seq >= l.nextSeq() {
+		return ErrEmpty
+	}
+
+	seg := l.segment(r.seq)
+
+	if err = cb(r.seq, seg.slice(int64(r.seq-seg.head.firstSeq))); err != nil && undoOnError {
+		return
+	}
+
+	r.seq++
+	return
+}
+
+// Segments are named by the sequence number of their first item, padded so
+// that they sort in order.
+func logSegmentName(firstSeq uint64) string {
+	return fmt.Sprintf("%020d%s", firstSeq, logSegmentExt)
+}
+
+func createLogSegment(path string, capacity int, itemSize int64, firstSeq uint64) (seg *logSegment, err error) {
+	seg = &logSegment{
+		path: path,
+		head: newSegmentHeader(capacity, itemSize),
+	}
+
+	seg.head.firstSeq = firstSeq
+	seg.head.writtenAt = time.Now().UnixNano()
+	seg.size = seg.head.fileSize()
+
+	// Never truncate an existing segment
+	if seg.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666); err != nil {
+		return
+	}
+
+	// Don't leave an uninitialized segment behind, as it would be in the way
+	// of the next attempt
+	defer func() {
+		if err != nil {
+			if seg.data != nil {
+				seg.data.Unmap()
+			}
+
+			seg.file.Close()
+			os.Remove(path)
+		}
+	}()
+
+	if err = flock.Lock(seg.file, true); err != nil {
+		return
+	}
+
+	if err = seg.file.Truncate(seg.size); err != nil {
+		return
+	}
+
+	if seg.data, err = mmap.Map(seg.file, mmap.RDWR, 0); err != nil {
+		return
+	}
+
+	seg.store.mapSlots(seg.data)
+	seg.store.init(seg.head)
+	err = seg.flush()
+	return
+}
+
+// Remove a segment file whose header was never written. Returns whether the
+// file was removed.
+func removeUninitializedLogSegment(path string) (removed bool, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+
+	if err != nil {
+		return
+	}
+
+	if err = flock.Lock(f, true); err != nil {
+		f.Close()
+		return
+	}
+
+	b := make([]byte, unsafe.Sizeof(headerSlots[segmentHeader]{}))
+	n, err := io.ReadFull(f, b)
+	f.Close()
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	} else if err != nil {
+		return
+	}
+
+	for _, c := range b[:n] {
+		if c != 0 {
+			return
+		}
+	}
+
+	return true, os.Remove(path)
+}
+
+func openLogSegment(path string, itemSize int64) (seg *logSegment, err error) {
+	seg = &logSegment{
+		path: path,
+		head: newSegmentHeader(0, itemSize),
+	}
+
+	defer flock.CloseOnError(&err, &seg.file, &seg.data)
+
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return
+	}
+
+	if seg.file, err = os.OpenFile(path, os.O_RDWR, 0); err != nil {
+		return
+	}
+
+	if err = flock.Lock(seg.file, true); err != nil {
+		return
+	}
+
+	if err = seg.validateHead(info.Size()); err != nil {
+		return nil, fmt.Errorf("log segment %s: %w", path, err)
+	}
+
+	if seg.data, err = mmap.Map(seg.file, mmap.RDWR, 0); err != nil {
+		return
+	}
+
+	seg.store.mapSlots(seg.data)
+
+	if !seg.store.load(seg.head) {
+		seg.close()
+		return nil, fmt.Errorf("log segment %s: corrupt header", path)
+	}
+
+	if seg.head.itemSize != itemSize {
+		seg.close()
+		return nil, fmt.Errorf("log segment %s: item size mismatch", path)
+	}
+
+	if filepath.Base(path) != logSegmentName(seg.head.firstSeq) {
+		seg.close()
+		return nil, fmt.Errorf("log segment %s: name doesn't match first sequence number %d", path, seg.head.firstSeq)
+	}
+
+	seg.size = info.Size()
+	return
+}
+
+func (seg *logSegment) validateHead(fileSize int64) (err error) {
+	if fileSize < int64(seg.head.headSize) {
+		return errors.New("file too small")
+	}
+
+	if _, err = seg.file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	b := make([]byte, seg.head.headSize)
+
+	if _, err = io.ReadFull(seg.file, b); err != nil {
+		return
+	}
+
+	slots := utils.BytesToPointer[headerSlots[segmentHeader]](b)
+
+	if err = slots[0].head.preamble.Validate(&seg.head.preamble); err != nil {
+		return
+	}
+
+	latest := slots.latest()
+
+	if latest == nil {
+		return errors.New("corrupt header")
+	}
+
+	head := &latest.head
+
+	if head.headSize != seg.head.headSize {
+		return errors.New("invalid header size")
+	}
+
+	if head.itemSize < 1 {
+		return errors.New("invalid item size")
+	}
+
+	if head.capacity < 1 || head.capacity < head.length || head.length < 0 {
+		return errors.New("invalid capacity")
+	}
+
+	if fileSize != head.fileSize() {
+		return errors.New("invalid file size")
+	}
+
+	return
+}
+
+func (seg *logSegment) full() bool {
+	return seg.head.length >= seg.head.capacity
+}
+
+// Sequence number after the last item.
+func (seg *logSegment) nextSeq() uint64 {
+	return seg.head.firstSeq + uint64(seg.head.length)
+}
+
+func (seg *logSegment) commit() {
+	seg.store.commit(seg.head)
+}
+
+func (seg *logSegment) flush() error {
+	return seg.data.Flush()
+}
+
+func (seg *logSegment) close() (err error) {
+	if err = seg.flush(); err != nil {
+		return
+	}
+
+	// The mapping must be released for the lock of the file to be released
+	if err = seg.data.Unmap(); err != nil {
+		return
+	}
+
+	return seg.file.Close()
+}
+
+func (seg *logSegment) slice(index int64) []byte {
+	index *= seg.head.itemSize
+	index += seg.head.headSize
+	return seg.data[index : index+seg.head.itemSize]
+}
@@ -0,0 +1,139 @@
+package channel
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func appendLog(t *testing.T, l *Log, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		if _, err := l.Append(func(b []byte) { b[0] = byte(l.nextSeq()) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkLog(t *testing.T, l *Log, firstSeq, nextSeq uint64, segments int) {
+	t.Helper()
+
+	if seq := l.FirstSeq(); seq != firstSeq {
+		t.Fatalf("expected first sequence number %d, got %d", firstSeq, seq)
+	}
+
+	if seq := l.NextSeq(); seq != nextSeq {
+		t.Fatalf("expected next sequence number %d, got %d", nextSeq, seq)
+	}
+
+	if n := l.Segments(); n != segments {
+		t.Fatalf("expected %d segments, got %d", segments, n)
+	}
+
+	r, err := l.NewReader(firstSeq)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for seq := firstSeq; seq < nextSeq; seq++ {
+		if err = r.ReadToCallback(func(s uint64, b []byte) error {
+			if s != seq || b[0] != byte(seq) {
+				t.Fatalf("expected item %d, got %d with sequence number %d", seq, b[0], s)
+			}
+
+			return nil
+		}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	segmentSize := newSegmentHeader(2, 1).fileSize()
+
+	tests := []struct {
+		name     string
+		appends  int
+		maxBytes int64
+		firstSeq uint64
+		segments int
+	}{
+		{"empty", 0, 0, 0, 1},
+		{"one segment", 2, 0, 0, 1},
+		{"rolled", 5, 0, 0, 3},
+		{"retained by size", 7, 2 * segmentSize, 4, 2},
+		{"active segment kept", 3, 1, 2, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opt := LogOptions{SegmentSize: 2, MaxBytes: tt.maxBytes}
+			l, err := NewLog(dir, 1, opt)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			appendLog(t, l, tt.appends)
+			checkLog(t, l, tt.firstSeq, uint64(tt.appends), tt.segments)
+
+			if err = l.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if l, err = NewLog(dir, 1, opt); err != nil {
+				t.Fatal(err)
+			}
+
+			defer l.Close()
+
+			checkLog(t, l, tt.firstSeq, uint64(tt.appends), tt.segments)
+		})
+	}
+}
+
+func TestLogUninitializedSegment(t *testing.T) {
+	tests := []struct {
+		name string
+		size int64
+	}{
+		{"empty file", 0},
+		{"zeroed header", newSegmentHeader(2, 1).fileSize()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			opt := LogOptions{SegmentSize: 2}
+			l, err := NewLog(dir, 1, opt)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			appendLog(t, l, 2)
+
+			if err = l.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Leave a segment behind as if rolling had been interrupted
+			if err = os.WriteFile(filepath.Join(dir, logSegmentName(2)), make([]byte, tt.size), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			if l, err = NewLog(dir, 1, opt); err != nil {
+				t.Fatal(err)
+			}
+
+			defer l.Close()
+
+			checkLog(t, l, 0, 2, 1)
+			appendLog(t, l, 1)
+			checkLog(t, l, 0, 3, 2)
+		})
+	}
+}
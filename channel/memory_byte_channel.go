@@ -2,13 +2,14 @@ package channel
 
 import (
 	"context"
+	"errors"
 	"sync"
 )
 
 type MemoryByteChannel struct {
 	data          []byte
-	readCond      sync.Cond // Awaited by readers, notified by writers.
-	writeCond     sync.Cond // Awaited by writers, notified by readers.
+	readable      notifier // Awaited by readers, notified by writers.
+	writable      notifier // Awaited by writers, notified by readers.
 	mu            sync.Mutex
 	itemSize      int64
 	startIdx      int64
@@ -16,6 +17,7 @@ type MemoryByteChannel struct {
 	capacity      int64
 	itemsWritten  uint64
 	itemsRead     uint64
+	batch         [][]byte // Reused by ReadBatch.
 	closedWriting bool
 }
 
@@ -26,9 +28,6 @@ func NewMemoryByteChannel(capacity int, itemSize int) (ch *MemoryByteChannel) {
 		capacity: int64(capacity),
 	}
 
-	ch.readCond.L = &ch.mu
-	ch.writeCond.L = &ch.mu
-
 	return
 }
 
@@ -57,24 +56,31 @@ func (ch *MemoryByteChannel) CopyTo(dst *MemoryByteChannel) {
 }
 
 func (ch *MemoryByteChannel) WriteOrBlock(cb func([]byte)) bool {
+	return ch.WriteCtx(context.Background(), cb) == nil
+}
+
+// Write an item, blocking while the channel is full until the context is done.
+func (ch *MemoryByteChannel) WriteCtx(ctx context.Context, cb func([]byte)) (err error) {
 	ch.mu.Lock()
 	defer ch.mu.Unlock()
 
 	if ch.closedWriting {
-		return false
+		return ErrWritingClosed
 	}
 
 	for !ch.spaceLeft() {
 		if ch.closedWriting {
-			return false
+			return ErrWritingClosed
 		}
 
 		// Wait until there is space in the buffer
-		ch.writeCond.Wait()
+		if err = ch.writable.wait(ctx, &ch.mu); err != nil {
+			return
+		}
 	}
 
 	ch.write(cb)
-	return true
+	return
 }
 
 func (ch *MemoryByteChannel) WriteOrFail(cb func([]byte)) bool {
@@ -112,10 +118,59 @@ func (ch *MemoryByteChannel) write(cb func([]byte)) {
 	}
 
 	ch.itemsWritten++
-	ch.readCond.Broadcast()
+	ch.readable.broadcast()
+}
+
+// Write n items, blocking while the channel is full. As many items as there is
+// space for are written at once, and the callback is called with the index of
+// each item in the batch. Returns the number of items written, which is less
+// than n only if writing is closed.
+func (ch *MemoryByteChannel) WriteBatch(n int, cb func(i int, b []byte)) (written int) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	for written < n {
+		for !ch.spaceLeft() {
+			if ch.closedWriting {
+				return
+			}
+
+			// Wait until there is space in the buffer
+			ch.writable.wait(context.Background(), &ch.mu)
+		}
+
+		if ch.closedWriting {
+			return
+		}
+
+		written += ch.writeBatch(written, n-written, cb)
+	}
+
+	return
+}
+
+// Write up to n items to the free slots.
+func (ch *MemoryByteChannel) writeBatch(offset int, n int, cb func(i int, b []byte)) int {
+	if free := ch.capacity - ch.length; int64(n) > free {
+		n = int(free)
+	}
+
+	for i := 0; i < n; i++ {
+		cb(offset+i, ch.slice(ch.index(ch.length+int64(i))))
+	}
+
+	ch.length += int64(n)
+	ch.itemsWritten += uint64(n)
+	ch.readable.broadcast()
+	return n
 }
 
 func (ch *MemoryByteChannel) Wait() (ok bool) {
+	return ch.WaitCtx(context.Background()) == nil
+}
+
+// Wait until there is anything to read, or until the context is done.
+func (ch *MemoryByteChannel) WaitCtx(ctx context.Context) (err error) {
 	ch.mu.Lock()
 	defer ch.mu.Unlock()
 
@@ -124,13 +179,15 @@ func (ch *MemoryByteChannel) Wait() (ok bool) {
 
 		// If writing is closed, there will never be any more to read
 		if ch.closedWriting {
-			return
+			return ErrWritingClosed
 		}
 
-		ch.readCond.Wait()
+		if err = ch.readable.wait(ctx, &ch.mu); err != nil {
+			return
+		}
 	}
 
-	return true
+	return
 }
 
 func (ch *MemoryByteChannel) ReadToCallback(cb func([]byte) error, undoOnError bool) (err error) {
@@ -146,32 +203,88 @@ func (ch *MemoryByteChannel) ReadToCallback(cb func([]byte) error, undoOnError b
 
 	if undoOnError && err != nil {
 		ch.undoRead()
-		ch.readCond.Broadcast()
+		ch.readable.broadcast()
 	} else {
-		ch.writeCond.Broadcast()
+		ch.writable.broadcast()
 	}
 
 	return
 }
 
-func (ch *MemoryByteChannel) WaitForSync(ctx context.Context) error {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel() // Ensure that the child context is canceled when we're done
+// Read up to max items at once. The items are only consumed if the callback
+// returns nil, and the slices are only valid until it returns.
+func (ch *MemoryByteChannel) ReadBatch(max int, cb func([][]byte) error) (err error) {
+	if max < 1 {
+		return errors.New("max must be at least 1")
+	}
 
-	// This goroutine waits for the context to be done and then signals the main goroutine.
-	go func() {
-		<-ctx.Done()
-		ch.writeCond.Broadcast() // wake up the main goroutine
-	}()
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	// If there is nothing to read, fail
+	if ch.empty() {
+		return ErrEmpty
+	}
+
+	n := ch.length
+
+	if int64(max) < n {
+		n = int64(max)
+	}
+
+	ch.batch = ch.batch[:0]
+
+	for i := int64(0); i < n; i++ {
+		ch.batch = append(ch.batch, ch.slice(ch.index(i)))
+	}
+
+	if err = cb(ch.batch); err != nil {
+		return
+	}
+
+	ch.startIdx = ch.index(n)
+	ch.length -= n
+	ch.itemsRead += uint64(n)
+	ch.writable.broadcast()
+	return
+}
+
+// Call the callback with the next item without reading it. The slice is only
+// valid until the callback returns.
+func (ch *MemoryByteChannel) Peek(cb func([]byte) error) (err error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	// If there is nothing to read, fail
+	if ch.empty() {
+		return ErrEmpty
+	}
+
+	return cb(ch.slice(ch.index(0)))
+}
 
+// Nothing is persisted, so any item type can be used.
+func (ch *MemoryByteChannel) setFingerprint(fingerprint uint64) error {
+	return nil
+}
+
+// Wait until the channel is empty, or until the context is done.
+func (ch *MemoryByteChannel) WaitUntilEmptyCtx(ctx context.Context) (err error) {
 	ch.mu.Lock()
-	for !ch.empty() && ctx.Err() == nil {
-		ch.writeCond.Wait() // wait either for items to be read or for the context to be done
+	defer ch.mu.Unlock()
+
+	for !ch.empty() {
+		if err = ch.writable.wait(ctx, &ch.mu); err != nil {
+			return
+		}
 	}
-	ch.mu.Unlock()
 
-	// If the context was cancelled or timed out, return its error.
-	return ctx.Err()
+	return
+}
+
+// Same as WaitUntilEmptyCtx.
+func (ch *MemoryByteChannel) WaitForSync(ctx context.Context) error {
+	return ch.WaitUntilEmptyCtx(ctx)
 }
 
 func (ch *MemoryByteChannel) read() []byte {
@@ -210,7 +323,8 @@ func (ch *MemoryByteChannel) CloseWriting() {
 
 	if !ch.closedWriting {
 		ch.closedWriting = true
-		ch.writeCond.Broadcast()
+		ch.readable.broadcast()
+		ch.writable.broadcast()
 	}
 }
 
@@ -219,6 +333,8 @@ func (ch *MemoryByteChannel) Close() (err error) {
 	defer ch.mu.Unlock()
 
 	ch.closedWriting = true
+	ch.readable.broadcast()
+	ch.writable.broadcast()
 
 	return ch.flush()
 }
@@ -273,7 +389,7 @@ func (ch *MemoryByteChannel) Reset() {
 
 	ch.startIdx = 0
 	ch.length = 0
-	ch.writeCond.Broadcast()
+	ch.writable.broadcast()
 }
 
 func (ch *MemoryByteChannel) ItemsWritten() uint64 {
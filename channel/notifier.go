@@ -0,0 +1,40 @@
+package channel
+
+import (
+	"context"
+	"sync"
+)
+
+// Broadcast notification, that unlike sync.Cond can be awaited together with a
+// context. Each broadcast closes the current channel, and the next waiter
+// creates a new one.
+type notifier struct {
+	ch chan struct{}
+}
+
+// Wait until notified or until the context is done, while holding mu.
+func (n *notifier) wait(ctx context.Context, mu sync.Locker) (err error) {
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+
+	ch := n.ch
+	mu.Unlock()
+
+	select {
+	case <-ch:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	mu.Lock()
+	return
+}
+
+// Wake up all waiters. Must be called while holding the same lock as the waiters.
+func (n *notifier) broadcast() {
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
@@ -0,0 +1,499 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The lane of an item is stored in the highest bits of its delivery tag.
+const (
+	priorityLaneBits  = 8
+	priorityLaneShift = 64 - priorityLaneBits
+	priorityTagMask   = 1<<priorityLaneShift - 1
+	MaxPriorityLanes  = 1 << priorityLaneBits
+)
+
+// An acknowledged channel with several priority lanes, each being an
+// AckByteChannel in a file of its own. Lane 0 has the highest priority. By
+// default, readers always drain higher lanes first - with weights, lanes are
+// instead read in proportion to their weights, so that low lanes aren't
+// starved. Items are acknowledged and rejected by their delivery tags, just
+// like in an AckByteChannel.
+type PriorityAckChannel struct {
+	readable notifier // Awaited by readers, notified by writers.
+	mu       sync.Mutex
+	lanes    []*AckByteChannel
+	weights  []int // Weight of each lane, or nil for strict priority.
+	current  []int // Current weight of each lane in the weighted round-robin.
+	timeout  time.Duration
+	closed   bool
+}
+
+// Open or create a channel with a number of lanes, stored in the files
+// "<filepath>.0", "<filepath>.1" and so on. All lanes have the same capacity
+// and item size.
+func NewPriorityAckChannel(filepath string, lanes int, capacity int, itemSize int) (p *PriorityAckChannel, err error) {
+	if lanes < 1 || lanes > MaxPriorityLanes {
+		return nil, fmt.Errorf("number of lanes must be between 1 and %d", MaxPriorityLanes)
+	}
+
+	p = &PriorityAckChannel{
+		lanes: make([]*AckByteChannel, 0, lanes),
+	}
+
+	for i := 0; i < lanes; i++ {
+		var lane *AckByteChannel
+
+		if lane, err = NewAckByteChannel(fmt.Sprintf("%s.%d", filepath, i), capacity, itemSize); err != nil {
+			p.Close()
+			return nil, err
+		}
+
+		p.lanes = append(p.lanes, lane)
+	}
+
+	return
+}
+
+// Read the lanes in proportion to their weights, with one weight per lane. A
+// lane with weight 0 is only read when all other lanes are empty. Without any
+// weights, higher lanes are always drained first.
+func (p *PriorityAckChannel) SetWeights(weights ...int) error {
+	if weights != nil && len(weights) != len(p.lanes) {
+		return fmt.Errorf("expected %d weights", len(p.lanes))
+	}
+
+	for _, w := range weights {
+		if w < 0 {
+			return errors.New("weights can't be negative")
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if weights == nil {
+		p.weights = nil
+		p.current = nil
+	} else {
+		p.weights = append([]int(nil), weights...)
+		p.current = make([]int, len(weights))
+	}
+
+	return nil
+}
+
+// Items that aren't acknowledged within the visibility timeout are delivered
+// again. By default, items never expire.
+func (p *PriorityAckChannel) SetVisibilityTimeout(timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.timeout = timeout
+
+	for _, lane := range p.lanes {
+		lane.SetVisibilityTimeout(timeout)
+	}
+
+	p.readable.broadcast()
+}
+
+func (p *PriorityAckChannel) Lanes() int {
+	return len(p.lanes)
+}
+
+// Lane of a delivery tag.
+func (p *PriorityAckChannel) Lane(tag uint64) int {
+	return int(tag >> priorityLaneShift)
+}
+
+func (p *PriorityAckChannel) lane(lane int) (*AckByteChannel, error) {
+	if lane < 0 || lane >= len(p.lanes) {
+		return nil, ErrInvalidLane
+	}
+
+	return p.lanes[lane], nil
+}
+
+func (p *PriorityAckChannel) WriteOrBlock(lane int, cb func([]byte)) bool {
+	return p.WriteCtx(context.Background(), lane, cb) == nil
+}
+
+// Write an item to a lane, blocking while the lane is full until the context
+// is done.
+func (p *PriorityAckChannel) WriteCtx(ctx context.Context, lane int, cb func([]byte)) (err error) {
+	ch, err := p.lane(lane)
+
+	if err != nil {
+		return
+	}
+
+	if err = ch.WriteCtx(ctx, cb); err == nil {
+		p.wakeReaders()
+	}
+
+	return
+}
+
+func (p *PriorityAckChannel) WriteOrFail(lane int, cb func([]byte)) bool {
+	ch, err := p.lane(lane)
+
+	if err != nil || !ch.WriteOrFail(cb) {
+		return false
+	}
+
+	p.wakeReaders()
+	return true
+}
+
+func (p *PriorityAckChannel) WriteOrReplace(lane int, cb func([]byte)) bool {
+	ch, err := p.lane(lane)
+
+	if err != nil || !ch.WriteOrReplace(cb) {
+		return false
+	}
+
+	p.wakeReaders()
+	return true
+}
+
+func (p *PriorityAckChannel) wakeReaders() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.readable.broadcast()
+}
+
+// Wait until there is anything to read
+func (p *PriorityAckChannel) Wait() (unread int64, err error) {
+	return p.WaitCtx(context.Background())
+}
+
+// Wait until there is anything to read in any lane, or until the context is
+// done.
+func (p *PriorityAckChannel) WaitCtx(ctx context.Context) (unread int64, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for !p.closed {
+		if unread = p.unread(); unread > 0 {
+			return
+		}
+
+		// If writing is closed, there will never be any more to read
+		if p.closedWriting() {
+			return 0, ErrWritingClosed
+		}
+
+		if err = p.waitRead(ctx); err != nil {
+			return
+		}
+	}
+
+	return 0, ErrClosed
+}
+
+// Wait for writers while holding the lock, until notified, until the context
+// is done or until a delivered item might have expired.
+func (p *PriorityAckChannel) waitRead(ctx context.Context) (err error) {
+	if p.timeout > 0 {
+		timeout := p.timeout
+
+		if timeout > sharedWaitTimeout {
+			timeout = sharedWaitTimeout
+		}
+
+		expiryCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		if err = p.readable.wait(expiryCtx, &p.mu); ctx.Err() == nil {
+			err = nil
+		}
+
+		return
+	}
+
+	return p.readable.wait(ctx, &p.mu)
+}
+
+func (p *PriorityAckChannel) ReadToCallback(cb func([]byte) error, undoOnError bool) (err error) {
+	return p.ReadDelivery(func(d Delivery) error {
+		return cb(d.Data)
+	}, undoOnError)
+}
+
+// Read the next item from the lane that is due. The item must be acknowledged
+// with its tag once handled, in any order. The lane is locked until the
+// callback returns, but the callback may use the other lanes.
+func (p *PriorityAckChannel) ReadDelivery(cb func(d Delivery) error, undoOnError bool) (err error) {
+	for {
+		p.mu.Lock()
+
+		if p.closed {
+			p.mu.Unlock()
+			return ErrClosed
+		}
+
+		lane := p.next()
+		p.mu.Unlock()
+
+		// If there is nothing to read, fail
+		if lane < 0 {
+			return ErrEmpty
+		}
+
+		var called bool
+
+		err = p.lanes[lane].ReadDelivery(func(d Delivery) error {
+			called = true
+			d.Tag |= uint64(lane) << priorityLaneShift
+			return cb(d)
+		}, undoOnError)
+
+		// Another reader might have emptied the lane since it was chosen
+		if err == ErrEmpty && !called {
+			continue
+		}
+
+		// The item is delivered again
+		if undoOnError && err != nil && called {
+			p.wakeReaders()
+		}
+
+		return
+	}
+}
+
+// Lane to read from next, or -1 if all lanes are empty. With weights, the lane
+// is chosen by smooth weighted round-robin among the weighted lanes with
+// anything to read. Lanes with weight 0 are only read when no weighted lane has
+// anything to read.
+func (p *PriorityAckChannel) next() (best int) {
+	var total int
+	best, fallback := -1, -1
+
+	for i, lane := range p.lanes {
+		if lane.Unread() <= 0 {
+			// A lane starts over once it has anything to read again
+			if p.weights != nil {
+				p.current[i] = 0
+			}
+
+			continue
+		}
+
+		if p.weights == nil {
+			return i
+		}
+
+		if p.weights[i] == 0 {
+			if fallback < 0 {
+				fallback = i
+			}
+
+			continue
+		}
+
+		total += p.weights[i]
+		p.current[i] += p.weights[i]
+
+		if best < 0 || p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+
+	if best < 0 {
+		return fallback
+	}
+
+	p.current[best] -= total
+	return
+}
+
+// Acknowledge delivered items by their tags, in any order, or the oldest
+// delivered item of the highest lane with any if no tag is given. Fails with
+// ErrUnknownTag if any of the items isn't awaiting acknowledgement, but the
+// other items are still acknowledged.
+func (p *PriorityAckChannel) Ack(tags ...uint64) (err error) {
+	if tags == nil {
+		p.AckN(1)
+		return
+	}
+
+	for _, tag := range tags {
+		if e := p.settle(tag, (*AckByteChannel).Ack); e != nil {
+			err = e
+		}
+	}
+
+	return
+}
+
+// Acknowledge up to n of the oldest delivered items at once, starting with the
+// highest lane. Returns the number of acknowledged items.
+func (p *PriorityAckChannel) AckN(n int) (acked int) {
+	for _, lane := range p.lanes {
+		if acked >= n {
+			break
+		}
+
+		acked += lane.AckN(n - acked)
+	}
+
+	return
+}
+
+// Reject delivered items by their tags, or the oldest delivered item of the
+// highest lane with any if no tag is given, so that they are delivered again.
+// Fails with ErrUnknownTag if any of the items isn't awaiting acknowledgement,
+// but the other items are still rejected.
+func (p *PriorityAckChannel) Nack(tags ...uint64) (err error) {
+	defer p.wakeReaders()
+
+	if tags == nil {
+		for _, lane := range p.lanes {
+			if lane.ToAck() {
+				return lane.Nack()
+			}
+		}
+
+		return
+	}
+
+	for _, tag := range tags {
+		if e := p.settle(tag, (*AckByteChannel).Nack); e != nil {
+			err = e
+		}
+	}
+
+	return
+}
+
+// Acknowledge or reject an item in its lane.
+func (p *PriorityAckChannel) settle(tag uint64, fn func(ch *AckByteChannel, tags ...uint64) error) error {
+	ch, err := p.lane(p.Lane(tag))
+
+	if err != nil {
+		return ErrUnknownTag
+	}
+
+	return fn(ch, tag&priorityTagMask)
+}
+
+// Deliver all unacknowledged items in all lanes again. Returns the number of
+// items that will be delivered again.
+func (p *PriorityAckChannel) Rewind() (count int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, lane := range p.lanes {
+		count += lane.Rewind()
+	}
+
+	if count > 0 {
+		p.readable.broadcast()
+	}
+
+	return
+}
+
+func (p *PriorityAckChannel) Flush() (err error) {
+	for _, lane := range p.lanes {
+		if err = lane.Flush(); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (p *PriorityAckChannel) CloseWriting() {
+	for _, lane := range p.lanes {
+		lane.CloseWriting()
+	}
+
+	p.wakeReaders()
+}
+
+func (p *PriorityAckChannel) closedWriting() bool {
+	for _, lane := range p.lanes {
+		lane.mu.Lock()
+		closed := lane.closedWriting
+		lane.mu.Unlock()
+
+		if !closed {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *PriorityAckChannel) Close() (err error) {
+	p.mu.Lock()
+	p.closed = true
+	p.readable.broadcast()
+	p.mu.Unlock()
+
+	for _, lane := range p.lanes {
+		if e := lane.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return
+}
+
+func (p *PriorityAckChannel) Empty() bool {
+	return p.Len() <= 0
+}
+
+// Number of items in all lanes, including delivered items awaiting
+// acknowledgement.
+func (p *PriorityAckChannel) Len() (n int64) {
+	for _, lane := range p.lanes {
+		n += lane.Len()
+	}
+
+	return
+}
+
+// Number of items to read in all lanes, including items to deliver again.
+func (p *PriorityAckChannel) Unread() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.unread()
+}
+
+func (p *PriorityAckChannel) unread() (n int64) {
+	for _, lane := range p.lanes {
+		n += lane.Unread()
+	}
+
+	return
+}
+
+// Number of delivered items awaiting acknowledgement in all lanes.
+func (p *PriorityAckChannel) AwaitingAck() (n int64) {
+	for _, lane := range p.lanes {
+		n += lane.AwaitingAck()
+	}
+
+	return
+}
+
+// Number of items in a lane, including delivered items awaiting
+// acknowledgement.
+func (p *PriorityAckChannel) LaneLen(lane int) int64 {
+	ch, err := p.lane(lane)
+
+	if err != nil {
+		return 0
+	}
+
+	return ch.Len()
+}
@@ -0,0 +1,253 @@
+package channel
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeLanes(t *testing.T, p *PriorityAckChannel, items []int) {
+	t.Helper()
+
+	for lane, n := range items {
+		for i := 0; i < n; i++ {
+			if !p.WriteOrFail(lane, func(b []byte) { b[0] = byte(lane) }) {
+				t.Fatalf("failed to write to lane %d", lane)
+			}
+		}
+	}
+}
+
+func TestPriorityAckChannelLanes(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		items   []int // Number of items in each lane.
+		want    []int // Lanes in the order they are read.
+	}{
+		{"strict", nil, []int{2, 2}, []int{0, 0, 1, 1}},
+		{"strict low lanes", nil, []int{0, 1, 2}, []int{1, 2, 2}},
+		{"weighted", []int{2, 1}, []int{4, 4}, []int{0, 1, 0, 0, 1, 0, 1, 1}},
+		{"weight 0", []int{1, 0}, []int{2, 1}, []int{0, 0, 1}},
+		{"weight 0 after emptied lane", []int{1, 5, 0}, []int{2, 3, 1}, []int{1, 1, 0, 1, 0, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ch")
+			p, err := NewPriorityAckChannel(path, len(tt.items), 8, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err = p.SetWeights(tt.weights...); err != nil {
+				t.Fatal(err)
+			}
+
+			writeLanes(t, p, tt.items)
+
+			var got []int
+
+			for range tt.want {
+				var tag uint64
+
+				if err = p.ReadDelivery(func(d Delivery) error {
+					if int(d.Data[0]) != p.Lane(d.Tag) {
+						t.Fatalf("item of lane %d delivered with tag of lane %d", d.Data[0], p.Lane(d.Tag))
+					}
+
+					tag = d.Tag
+					return nil
+				}, false); err != nil {
+					t.Fatal(err)
+				}
+
+				got = append(got, p.Lane(tag))
+
+				if err = p.Ack(tag); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Fatalf("expected lanes %v, got %v", tt.want, got)
+				}
+			}
+
+			if !p.Empty() {
+				t.Fatalf("expected an empty channel, got length %d", p.Len())
+			}
+
+			if err = p.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPriorityAckChannelAckN(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       int
+		want    int
+		wantLen int64
+	}{
+		{"across lanes", 3, 3, 1},
+		{"some", 2, 2, 2},
+		{"more than delivered", 10, 3, 1},
+		{"zero", 0, 0, 4},
+		{"negative", -1, 0, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ch")
+			p, err := NewPriorityAckChannel(path, 2, 4, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			writeLanes(t, p, []int{2, 2})
+
+			for i := 0; i < 3; i++ {
+				if err = p.ReadToCallback(func([]byte) error { return nil }, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if acked := p.AckN(tt.n); acked != tt.want {
+				t.Fatalf("expected %d acked, got %d", tt.want, acked)
+			}
+
+			if l := p.Len(); l != tt.wantLen {
+				t.Fatalf("expected length %d, got %d", tt.wantLen, l)
+			}
+
+			if err = p.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if p, err = NewPriorityAckChannel(path, 2, 4, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			defer p.Close()
+
+			if l := p.Len(); l != tt.wantLen {
+				t.Fatalf("expected length %d after reopening, got %d", tt.wantLen, l)
+			}
+		})
+	}
+}
+
+func TestPriorityAckChannelSettle(t *testing.T) {
+	// Tags of an item in an invalid lane, and of an unknown item in lane 0
+	invalidLane := uint64(5) << priorityLaneShift
+	unknown := uint64(100)
+
+	tests := []struct {
+		name       string
+		settle     func(p *PriorityAckChannel, tags []uint64) error
+		wantErr    error
+		wantLen    int64
+		wantUnread int64
+	}{
+		{"ack oldest", func(p *PriorityAckChannel, tags []uint64) error { return p.Ack() }, nil, 1, 0},
+		{"nack oldest", func(p *PriorityAckChannel, tags []uint64) error { return p.Nack() }, nil, 2, 1},
+		{"ack after invalid lane", func(p *PriorityAckChannel, tags []uint64) error { return p.Ack(invalidLane, tags[1]) }, ErrUnknownTag, 1, 0},
+		{"ack after unknown tag", func(p *PriorityAckChannel, tags []uint64) error { return p.Ack(unknown, tags[1]) }, ErrUnknownTag, 1, 0},
+		{"nack after invalid lane", func(p *PriorityAckChannel, tags []uint64) error { return p.Nack(invalidLane, tags[1]) }, ErrUnknownTag, 2, 1},
+		{"nack after unknown tag", func(p *PriorityAckChannel, tags []uint64) error { return p.Nack(unknown, tags[1]) }, ErrUnknownTag, 2, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPriorityAckChannel(filepath.Join(t.TempDir(), "ch"), 2, 4, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer p.Close()
+
+			writeLanes(t, p, []int{1, 1})
+
+			var tags []uint64
+
+			for i := 0; i < 2; i++ {
+				if err = p.ReadDelivery(func(d Delivery) error {
+					tags = append(tags, d.Tag)
+					return nil
+				}, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err = tt.settle(p, tags); err != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+
+			if l := p.Len(); l != tt.wantLen {
+				t.Fatalf("expected length %d, got %d", tt.wantLen, l)
+			}
+
+			if n := p.Unread(); n != tt.wantUnread {
+				t.Fatalf("expected %d unread, got %d", tt.wantUnread, n)
+			}
+		})
+	}
+}
+
+func TestPriorityAckChannelUseInCallback(t *testing.T) {
+	p, err := NewPriorityAckChannel(filepath.Join(t.TempDir(), "ch"), 2, 4, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeLanes(t, p, []int{0, 1})
+
+	var tag uint64
+
+	if err = p.ReadDelivery(func(d Delivery) error {
+		tag = d.Tag
+		return nil
+	}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	writeLanes(t, p, []int{1})
+	done := make(chan error, 1)
+
+	// Writing to and rejecting items in another lane while reading used to
+	// deadlock, so the test fails after a timeout instead of hanging. The
+	// channel is only closed if it isn't deadlocked.
+	go func() {
+		done <- p.ReadDelivery(func(d Delivery) error {
+			if !p.WriteOrFail(1, func(b []byte) { b[0] = 1 }) {
+				return errors.New("failed to write")
+			}
+
+			return p.Nack(tag)
+		}, false)
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlocked")
+	}
+
+	defer p.Close()
+
+	if n := p.Unread(); n != 2 {
+		t.Fatalf("expected 2 unread, got %d", n)
+	}
+}
@@ -0,0 +1,459 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/webbmaffian/go-mad/internal/flock"
+	"github.com/webbmaffian/go-mad/internal/preamble"
+	"github.com/webbmaffian/go-mad/internal/utils"
+)
+
+// A byte channel for exactly one writing goroutine and one reading goroutine.
+// The read and write positions are atomic counters in the file, so the writer
+// and the reader never contend on a mutex. As only the reader may move the
+// read position, items can't be replaced when the channel is full.
+type SPSCByteChannel struct {
+	data          mmap.MMap
+	file          *os.File
+	head          *header // Never changed while the channel is open.
+	store         headerStore[header]
+	ring          *ringState
+	readWake      chan struct{} // Wakes up a sleeping reader.
+	writeWake     chan struct{} // Wakes up a sleeping writer.
+	readBase      uint64        // Read position when opened.
+	writeBase     uint64        // Write position when opened.
+	closed        uint32
+	closedWriting uint32
+	_             [cacheLine]byte
+	writer        spscSide
+	reader        spscSide
+}
+
+// Everything in the file before the items.
+type spscFileHead struct {
+	slots headerSlots[header]
+	ring  ringState
+}
+
+const cacheLine = 64
+
+// Positions of the channel. They only ever increase, and are kept on separate
+// cache lines so that the producer and the consumer never write to the same
+// one.
+type ringState struct {
+	_    [cacheLine]byte
+	head uint64 // Number of items read.
+	_    [cacheLine - 8]byte
+	tail uint64 // Number of items written.
+	_    [cacheLine - 8]byte
+}
+
+func mapRingState(data []byte) *ringState {
+	return &utils.BytesToPointer[spscFileHead](data[:unsafe.Sizeof(spscFileHead{})]).ring
+}
+
+// State of either the writer or the reader, on its own cache line.
+type spscSide struct {
+	busy     uint32 // Number of goroutines in methods that access the file.
+	sleeping uint32 // Set while waiting to be woken up by the other side.
+	_        [cacheLine - 8]byte
+}
+
+func NewSPSCByteChannel(filepath string, capacity int, itemSize int) (ch *SPSCByteChannel, err error) {
+	ch = &SPSCByteChannel{
+		head:      newHeader(capacity, itemSize, preamble.KindSPSCChannel),
+		readWake:  make(chan struct{}, 1),
+		writeWake: make(chan struct{}, 1),
+	}
+
+	ch.head.headSize = int64(unsafe.Sizeof(spscFileHead{}))
+
+	defer flock.CloseOnError(&err, &ch.file, &ch.data)
+
+	var created bool
+	info, err := os.Stat(filepath)
+
+	if err == nil {
+		if ch.file, err = os.OpenFile(filepath, os.O_RDWR, 0); err != nil {
+			return
+		}
+
+		if err = flock.Lock(ch.file, true); err != nil {
+			return
+		}
+
+		if err = ch.validateHead(info.Size()); err != nil {
+			return
+		}
+	} else if os.IsNotExist(err) {
+		if ch.head.capacity == 0 {
+			return nil, errors.New("capacity is mandatory")
+		}
+
+		if ch.file, err = os.Create(filepath); err != nil {
+			return
+		}
+
+		if err = flock.Lock(ch.file, true); err != nil {
+			return
+		}
+
+		if err = ch.file.Truncate(int64(ch.head.fileSize())); err != nil {
+			return
+		}
+
+		created = true
+	} else {
+		return
+	}
+
+	if ch.data, err = mmap.Map(ch.file, mmap.RDWR, 0); err != nil {
+		return
+	}
+
+	ch.store.mapSlots(ch.data)
+	ch.ring = mapRingState(ch.data)
+
+	if created {
+		ch.store.init(ch.head)
+
+		if err = ch.data.Flush(); err != nil {
+			return
+		}
+	} else if !ch.store.load(ch.head) {
+		return nil, errors.New("corrupt header")
+	}
+
+	if ch.head.capacity != int64(capacity) || ch.head.itemSize != int64(itemSize) {
+		ch.Close()
+		return nil, errors.New("capacity and/or item size mismatch")
+	}
+
+	ch.readBase = ch.ring.head
+	ch.writeBase = ch.ring.tail
+
+	if ch.writeBase-ch.readBase > uint64(ch.head.capacity) {
+		ch.Close()
+		return nil, errors.New("invalid positions")
+	}
+
+	return
+}
+
+func (ch *SPSCByteChannel) validateHead(fileSize int64) (err error) {
+	if fileSize < int64(ch.head.headSize) {
+		return errors.New("file too small")
+	}
+
+	if ch.file == nil {
+		return errors.New("file is not open")
+	}
+
+	if _, err = ch.file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	b := make([]byte, ch.head.headSize)
+
+	if _, err = io.ReadFull(ch.file, b); err != nil {
+		return
+	}
+
+	slots := utils.BytesToPointer[headerSlots[header]](b)
+
+	if err = slots[0].head.preamble.Validate(&ch.head.preamble); err != nil {
+		return
+	}
+
+	latest := slots.latest()
+
+	if latest == nil {
+		return errors.New("corrupt header")
+	}
+
+	head := &latest.head
+
+	if head.headSize != ch.head.headSize {
+		return errors.New("invalid header size")
+	}
+
+	if head.itemSize < 1 {
+		return errors.New("invalid item size")
+	}
+
+	if head.capacity < 1 {
+		return errors.New("invalid capacity")
+	}
+
+	if fileSize != head.fileSize() {
+		return errors.New("invalid file size")
+	}
+
+	return
+}
+
+func (ch *SPSCByteChannel) WriteOrBlock(cb func([]byte)) bool {
+	return ch.WriteCtx(context.Background(), cb) == nil
+}
+
+// Write an item, blocking while the channel is full until the context is done.
+func (ch *SPSCByteChannel) WriteCtx(ctx context.Context, cb func([]byte)) (err error) {
+	if !ch.enter(&ch.writer, &ch.closedWriting) {
+		return ErrWritingClosed
+	}
+
+	defer ch.leave(&ch.writer)
+
+	tail := ch.ring.tail
+
+	for !ch.writable(tail) {
+		// Wait until there is space in the buffer
+		if err = ch.sleep(ctx, &ch.writer, ch.writeWake, &ch.closedWriting, func() bool { return ch.writable(tail) }); err != nil {
+			return
+		}
+
+		if atomic.LoadUint32(&ch.closedWriting) != 0 {
+			return ErrWritingClosed
+		}
+	}
+
+	ch.write(tail, cb)
+	return
+}
+
+func (ch *SPSCByteChannel) WriteOrFail(cb func([]byte)) bool {
+	if !ch.enter(&ch.writer, &ch.closedWriting) {
+		return false
+	}
+
+	defer ch.leave(&ch.writer)
+
+	tail := ch.ring.tail
+
+	if !ch.writable(tail) {
+		return false
+	}
+
+	ch.write(tail, cb)
+	return true
+}
+
+func (ch *SPSCByteChannel) writable(tail uint64) bool {
+	return tail-atomic.LoadUint64(&ch.ring.head) < uint64(ch.head.capacity)
+}
+
+func (ch *SPSCByteChannel) write(tail uint64, cb func([]byte)) {
+	cb(ch.slice(tail))
+
+	// Publish the item only after it's written
+	atomic.StoreUint64(&ch.ring.tail, tail+1)
+	ch.wake(&ch.reader, ch.readWake)
+}
+
+// Wait until there is anything to read. Returns false if writing is closed and
+// there will never be any more to read.
+func (ch *SPSCByteChannel) Wait() (ok bool) {
+	return ch.WaitCtx(context.Background()) == nil
+}
+
+// Wait until there is anything to read, or until the context is done.
+func (ch *SPSCByteChannel) WaitCtx(ctx context.Context) (err error) {
+	if !ch.enter(&ch.reader, &ch.closed) {
+		return ErrClosed
+	}
+
+	defer ch.leave(&ch.reader)
+
+	head := ch.ring.head
+
+	for !ch.readable(head) {
+
+		// If writing is closed, there will never be any more to read
+		if atomic.LoadUint32(&ch.closedWriting) != 0 && !ch.readable(head) {
+			return ErrWritingClosed
+		}
+
+		if err = ch.sleep(ctx, &ch.reader, ch.readWake, &ch.closed, func() bool {
+			return ch.readable(head) || atomic.LoadUint32(&ch.closedWriting) != 0
+		}); err != nil {
+			return
+		}
+
+		if atomic.LoadUint32(&ch.closed) != 0 {
+			return ErrClosed
+		}
+	}
+
+	return
+}
+
+func (ch *SPSCByteChannel) ReadToCallback(cb func([]byte) error, undoOnError bool) (err error) {
+	if !ch.enter(&ch.reader, &ch.closed) {
+		return ErrClosed
+	}
+
+	defer ch.leave(&ch.reader)
+
+	head := ch.ring.head
+
+	// If there is nothing to read, fail
+	if !ch.readable(head) {
+		return ErrEmpty
+	}
+
+	err = cb(ch.slice(head))
+
+	if undoOnError && err != nil {
+		return
+	}
+
+	// Release the slot only after it's read
+	atomic.StoreUint64(&ch.ring.head, head+1)
+	ch.wake(&ch.writer, ch.writeWake)
+	return
+}
+
+func (ch *SPSCByteChannel) readable(head uint64) bool {
+	return atomic.LoadUint64(&ch.ring.tail) != head
+}
+
+// Enter a method accessing the file, unless the channel is closed.
+func (ch *SPSCByteChannel) enter(s *spscSide, closed *uint32) bool {
+	atomic.AddUint32(&s.busy, 1)
+
+	if atomic.LoadUint32(closed) != 0 {
+		ch.leave(s)
+		return false
+	}
+
+	return true
+}
+
+func (ch *SPSCByteChannel) leave(s *spscSide) {
+	atomic.AddUint32(&s.busy, ^uint32(0))
+}
+
+// Sleep until woken up by the other side or until the context is done, unless
+// ready returns true or the channel is closed after announcing the sleep.
+func (ch *SPSCByteChannel) sleep(ctx context.Context, s *spscSide, wake chan struct{}, closed *uint32, ready func() bool) (err error) {
+	atomic.StoreUint32(&s.sleeping, 1)
+
+	if !ready() && atomic.LoadUint32(closed) == 0 {
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	atomic.StoreUint32(&s.sleeping, 0)
+	return
+}
+
+// Wake up the other side, if it's sleeping.
+func (ch *SPSCByteChannel) wake(s *spscSide, wake chan struct{}) {
+	if atomic.LoadUint32(&s.sleeping) != 0 {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (ch *SPSCByteChannel) Flush() error {
+	if !ch.enter(&ch.reader, &ch.closed) {
+		return ErrClosed
+	}
+
+	defer ch.leave(&ch.reader)
+
+	return ch.data.Flush()
+}
+
+func (ch *SPSCByteChannel) CloseWriting() {
+	if atomic.CompareAndSwapUint32(&ch.closedWriting, 0, 1) {
+		ch.wake(&ch.reader, ch.readWake)
+		ch.wake(&ch.writer, ch.writeWake)
+	}
+}
+
+// Close the channel. Goroutines waiting in WriteOrBlock or Wait are woken up,
+// and the file is released once they have returned.
+func (ch *SPSCByteChannel) Close() (err error) {
+	ch.CloseWriting()
+
+	if !atomic.CompareAndSwapUint32(&ch.closed, 0, 1) {
+		return
+	}
+
+	ch.wake(&ch.reader, ch.readWake)
+
+	for atomic.LoadUint32(&ch.writer.busy) != 0 || atomic.LoadUint32(&ch.reader.busy) != 0 {
+		ch.wake(&ch.reader, ch.readWake)
+		ch.wake(&ch.writer, ch.writeWake)
+		runtime.Gosched()
+	}
+
+	if err = ch.data.Flush(); err != nil {
+		return
+	}
+
+	// The mapping must be released for the lock of the file to be released
+	if err = ch.data.Unmap(); err != nil {
+		return
+	}
+
+	return ch.file.Close()
+}
+
+func (ch *SPSCByteChannel) Empty() bool {
+	return ch.Len() <= 0
+}
+
+func (ch *SPSCByteChannel) SpaceLeft() bool {
+	return ch.Len() < ch.Cap()
+}
+
+func (ch *SPSCByteChannel) Len() int64 {
+	head, tail := ch.positions()
+	return int64(tail - head)
+}
+
+func (ch *SPSCByteChannel) Cap() int64 {
+	return ch.head.capacity
+}
+
+func (ch *SPSCByteChannel) ItemsWritten() uint64 {
+	_, tail := ch.positions()
+	return tail - ch.writeBase
+}
+
+func (ch *SPSCByteChannel) ItemsRead() uint64 {
+	head, _ := ch.positions()
+	return head - ch.readBase
+}
+
+// Current read and write positions, or the positions when opened if closed.
+func (ch *SPSCByteChannel) positions() (head uint64, tail uint64) {
+	if !ch.enter(&ch.reader, &ch.closed) {
+		return ch.readBase, ch.writeBase
+	}
+
+	defer ch.leave(&ch.reader)
+
+	head = atomic.LoadUint64(&ch.ring.head)
+	tail = atomic.LoadUint64(&ch.ring.tail)
+	return
+}
+
+func (ch *SPSCByteChannel) slice(pos uint64) []byte {
+	index := int64(pos%uint64(ch.head.capacity))*ch.head.itemSize + ch.head.headSize
+	return ch.data[index : index+ch.head.itemSize]
+}
@@ -0,0 +1,229 @@
+package channel
+
+import (
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+const benchItemSize = 16
+
+func BenchmarkByteChannel(b *testing.B) {
+	ch, err := NewByteChannel(filepath.Join(b.TempDir(), "bench.ch"), 1024, benchItemSize)
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer ch.Close()
+
+	n := b.N
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < n; i++ {
+			ch.WriteOrBlock(func(b []byte) {
+				b[0] = byte(i)
+			})
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		ch.Wait()
+		ch.ReadToCallback(func(b []byte) error {
+			return nil
+		}, false)
+	}
+}
+
+func BenchmarkSPSCByteChannel(b *testing.B) {
+	ch, err := NewSPSCByteChannel(filepath.Join(b.TempDir(), "bench.spsc"), 1024, benchItemSize)
+
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer ch.Close()
+
+	n := b.N
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < n; i++ {
+			ch.WriteOrBlock(func(b []byte) {
+				b[0] = byte(i)
+			})
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		ch.Wait()
+		ch.ReadToCallback(func(b []byte) error {
+			return nil
+		}, false)
+	}
+}
+
+func TestSPSCByteChannel(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  string // Write (w), read (r), or fail to write to a full channel (f).
+	}{
+		{"empty", ""},
+		{"in order", "wwrr"},
+		{"wrapped", "wwwrrwwrrrww"},
+		{"full", "wwwf"},
+		{"full after wrapping", "wwrrwwwf"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ch")
+			ch, err := NewSPSCByteChannel(path, 3, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var written, read byte
+
+			readNext := func() {
+				t.Helper()
+
+				if err := ch.ReadToCallback(func(b []byte) error {
+					if b[0] != read {
+						t.Fatalf("expected %d, got %d", read, b[0])
+					}
+
+					return nil
+				}, false); err != nil {
+					t.Fatal(err)
+				}
+
+				read++
+			}
+
+			for _, op := range tt.ops {
+				switch op {
+				case 'w':
+					if !ch.WriteOrFail(func(b []byte) { b[0] = written }) {
+						t.Fatalf("failed to write %d", written)
+					}
+
+					written++
+				case 'f':
+					if ch.WriteOrFail(func(b []byte) { b[0] = 0xff }) {
+						t.Fatal("expected a full channel")
+					}
+				case 'r':
+					readNext()
+				}
+			}
+
+			// The positions are kept in the file
+			if err = ch.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if ch, err = NewSPSCByteChannel(path, 3, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			defer ch.Close()
+
+			if l := ch.Len(); l != int64(written-read) {
+				t.Fatalf("expected length %d after reopening, got %d", written-read, l)
+			}
+
+			for read < written {
+				readNext()
+			}
+
+			if err = ch.ReadToCallback(func([]byte) error { return nil }, false); err != ErrEmpty {
+				t.Fatalf("expected ErrEmpty, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSPSCByteChannelConcurrent(t *testing.T) {
+	const n = 10000
+
+	ch, err := NewSPSCByteChannel(filepath.Join(t.TempDir(), "ch"), 4, 2)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ch.Close()
+
+	go func() {
+		for i := 0; i < n; i++ {
+			ch.WriteOrBlock(func(b []byte) {
+				b[0], b[1] = byte(i), byte(i>>8)
+			})
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		if !ch.Wait() {
+			t.Fatal("expected an item")
+		}
+
+		if err = ch.ReadToCallback(func(b []byte) error {
+			if v := int(b[0]) | int(b[1])<<8; v != i&0xffff {
+				t.Fatalf("expected %d, got %d", i, v)
+			}
+
+			return nil
+		}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSPSCByteChannelCloseWhileBlocked(t *testing.T) {
+	tests := []struct {
+		name  string
+		side  func(ch *SPSCByteChannel) *spscSide
+		block func(ch *SPSCByteChannel) bool
+	}{
+		{"writer", func(ch *SPSCByteChannel) *spscSide { return &ch.writer }, func(ch *SPSCByteChannel) bool {
+			ch.WriteOrFail(func([]byte) {})
+			return ch.WriteOrBlock(func([]byte) {})
+		}},
+		{"reader", func(ch *SPSCByteChannel) *spscSide { return &ch.reader }, func(ch *SPSCByteChannel) bool {
+			return ch.Wait()
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch, err := NewSPSCByteChannel(filepath.Join(t.TempDir(), "ch"), 1, 1)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan bool)
+
+			go func() {
+				done <- tt.block(ch)
+			}()
+
+			// Close only once the goroutine is waiting
+			for atomic.LoadUint32(&tt.side(ch).sleeping) == 0 {
+				runtime.Gosched()
+			}
+
+			if err = ch.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if <-done {
+				t.Fatal("expected the blocked call to fail")
+			}
+		})
+	}
+}
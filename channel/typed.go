@@ -0,0 +1,193 @@
+package channel
+
+import (
+	"context"
+	"errors"
+	"unsafe"
+
+	"github.com/webbmaffian/go-mad/internal/utils"
+)
+
+// Operations shared by the byte channels that a typed channel can wrap.
+type byteChannel interface {
+	WriteCtx(ctx context.Context, cb func([]byte)) error
+	WriteOrFail(cb func([]byte)) bool
+	Peek(cb func([]byte) error) error
+	Flush() error
+	CloseWriting()
+	Close() error
+	Empty() bool
+	Len() int64
+	Cap() int64
+	setFingerprint(fingerprint uint64) error
+}
+
+// A channel of values of type T, stored directly in the slots of a byte
+// channel. Values are never copied on receive - the callback gets a pointer
+// into the channel, that is only valid until it returns. The type (`T`) MUST
+// NOT contain any pointer nor slice, which is validated on open.
+type Typed[T any] struct {
+	ch      byteChannel
+	wait    func(ctx context.Context) error
+	receive func(cb func([]byte) error) error
+}
+
+// Open or create a typed channel over a ByteChannel. The item size is the size
+// of T.
+func NewTypedByteChannel[T any](filepath string, capacity int, allowResize ...bool) (t *Typed[T], err error) {
+	if err = validateTyped[T](); err != nil {
+		return
+	}
+
+	ch, err := NewByteChannel(filepath, capacity, sizeOf[T](), allowResize...)
+
+	if err != nil {
+		return
+	}
+
+	return newTyped[T](ch, ch.WaitCtx, func(cb func([]byte) error) error {
+		return ch.ReadToCallback(cb, true)
+	})
+}
+
+// Open or create a typed channel over an AckByteChannel. The item size is the
+// size of T. Received values are acknowledged once the callback returns nil,
+// and are otherwise delivered again.
+func NewTypedAckByteChannel[T any](filepath string, capacity int, allowResize ...bool) (t *Typed[T], err error) {
+	if err = validateTyped[T](); err != nil {
+		return
+	}
+
+	ch, err := NewAckByteChannel(filepath, capacity, sizeOf[T](), allowResize...)
+
+	if err != nil {
+		return
+	}
+
+	return newTyped[T](ch, func(ctx context.Context) (err error) {
+		_, err = ch.WaitCtx(ctx)
+		return
+	}, func(cb func([]byte) error) (err error) {
+		var tag uint64
+
+		if err = ch.ReadDelivery(func(d Delivery) error {
+			tag = d.Tag
+			return cb(d.Data)
+		}, true); err != nil {
+			return
+		}
+
+		return ch.Ack(tag)
+	})
+}
+
+// Create a typed channel over a MemoryByteChannel. The item size is the size of
+// T.
+func NewTypedMemoryByteChannel[T any](capacity int) (t *Typed[T], err error) {
+	if err = validateTyped[T](); err != nil {
+		return
+	}
+
+	ch := NewMemoryByteChannel(capacity, sizeOf[T]())
+
+	return newTyped[T](ch, ch.WaitCtx, func(cb func([]byte) error) error {
+		return ch.ReadToCallback(cb, true)
+	})
+}
+
+func newTyped[T any](ch byteChannel, wait func(ctx context.Context) error, receive func(cb func([]byte) error) error) (t *Typed[T], err error) {
+	if err = ch.setFingerprint(utils.Fingerprint(utils.TypeOf[T]())); err != nil {
+		ch.Close()
+		return
+	}
+
+	t = &Typed[T]{
+		ch:      ch,
+		wait:    wait,
+		receive: receive,
+	}
+
+	return
+}
+
+func validateTyped[T any]() (err error) {
+	if err = utils.ValidatePlain[T](); err != nil {
+		return
+	}
+
+	if sizeOf[T]() <= 0 {
+		return errors.New("item must be at least 1 byte")
+	}
+
+	return
+}
+
+func sizeOf[T any]() int {
+	var v T
+	return int(unsafe.Sizeof(v))
+}
+
+// Send a value, blocking while the channel is full.
+func (t *Typed[T]) Send(v *T) error {
+	return t.SendCtx(context.Background(), v)
+}
+
+// Send a value, blocking while the channel is full until the context is done.
+func (t *Typed[T]) SendCtx(ctx context.Context, v *T) error {
+	return t.ch.WriteCtx(ctx, func(b []byte) {
+		*utils.BytesToPointer[T](b) = *v
+	})
+}
+
+// Send a value, unless the channel is full.
+func (t *Typed[T]) TrySend(v *T) bool {
+	return t.ch.WriteOrFail(func(b []byte) {
+		*utils.BytesToPointer[T](b) = *v
+	})
+}
+
+// Receive the next value. The value is only consumed if the callback returns
+// nil, and the pointer is only valid until it returns. Fails with ErrEmpty if
+// there is nothing to receive.
+func (t *Typed[T]) Receive(cb func(v *T) error) error {
+	return t.receive(func(b []byte) error {
+		return cb(utils.BytesToPointer[T](b))
+	})
+}
+
+// Call the callback with the next value without receiving it. The pointer is
+// only valid until the callback returns.
+func (t *Typed[T]) Peek(cb func(v *T) error) error {
+	return t.ch.Peek(func(b []byte) error {
+		return cb(utils.BytesToPointer[T](b))
+	})
+}
+
+// Wait until there is anything to receive, or until the context is done.
+func (t *Typed[T]) Wait(ctx context.Context) error {
+	return t.wait(ctx)
+}
+
+func (t *Typed[T]) Flush() error {
+	return t.ch.Flush()
+}
+
+func (t *Typed[T]) CloseWriting() {
+	t.ch.CloseWriting()
+}
+
+func (t *Typed[T]) Close() error {
+	return t.ch.Close()
+}
+
+func (t *Typed[T]) Empty() bool {
+	return t.ch.Empty()
+}
+
+func (t *Typed[T]) Len() int64 {
+	return t.ch.Len()
+}
+
+func (t *Typed[T]) Cap() int64 {
+	return t.ch.Cap()
+}
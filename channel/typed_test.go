@@ -0,0 +1,136 @@
+package channel
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+type typedPoint struct {
+	X, Y int32
+}
+
+type typedSize struct {
+	W, H int32
+}
+
+func TestTyped(t *testing.T) {
+	channels := []struct {
+		name string
+		open func(path string) (*Typed[typedPoint], error)
+		// Reopening the same file as a different type must fail.
+		reopenOther func(path string) error
+	}{
+		{"ByteChannel", func(path string) (*Typed[typedPoint], error) {
+			return NewTypedByteChannel[typedPoint](path, 4)
+		}, func(path string) error {
+			_, err := NewTypedByteChannel[typedSize](path, 4)
+			return err
+		}},
+		{"AckByteChannel", func(path string) (*Typed[typedPoint], error) {
+			return NewTypedAckByteChannel[typedPoint](path, 4)
+		}, func(path string) error {
+			_, err := NewTypedAckByteChannel[typedSize](path, 4)
+			return err
+		}},
+		{"MemoryByteChannel", func(string) (*Typed[typedPoint], error) {
+			return NewTypedMemoryByteChannel[typedPoint](4)
+		}, nil},
+	}
+
+	tests := []struct {
+		name    string
+		send    int
+		receive int
+		fail    bool // Whether the first receive fails.
+	}{
+		{"none received", 3, 0, false},
+		{"some received", 3, 2, false},
+		{"failed receive", 3, 1, true},
+		{"all received", 4, 4, false},
+	}
+
+	for _, c := range channels {
+		for _, tt := range tests {
+			t.Run(c.name+"/"+tt.name, func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "ch")
+				ch, err := c.open(path)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for i := 0; i < tt.send; i++ {
+					if err = ch.Send(&typedPoint{X: int32(i), Y: -int32(i)}); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if tt.fail {
+					if err = ch.Receive(func(*typedPoint) error {
+						return errors.New("failed")
+					}); err == nil {
+						t.Fatal("expected error")
+					}
+				}
+
+				next := 0
+
+				// Check that the next value is received, or left in the channel
+				expect := func(v *typedPoint) error {
+					if v.X != int32(next) || v.Y != -int32(next) {
+						t.Fatalf("expected value %d, got %+v", next, *v)
+					}
+
+					return nil
+				}
+
+				for ; next < tt.receive; next++ {
+					if err = ch.Receive(expect); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if c.reopenOther == nil {
+					if l := ch.Len(); l != int64(tt.send-tt.receive) {
+						t.Fatalf("expected length %d, got %d", tt.send-tt.receive, l)
+					}
+
+					return
+				}
+
+				if err = ch.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				if err = c.reopenOther(path); err == nil {
+					t.Fatal("expected error when reopening as another type")
+				}
+
+				if ch, err = c.open(path); err != nil {
+					t.Fatal(err)
+				}
+
+				defer ch.Close()
+
+				if l := ch.Len(); l != int64(tt.send-tt.receive) {
+					t.Fatalf("expected length %d after reopening, got %d", tt.send-tt.receive, l)
+				}
+
+				if err = ch.Peek(expect); err != nil && next < tt.send {
+					t.Fatal(err)
+				}
+
+				for ; next < tt.send; next++ {
+					if err = ch.Receive(expect); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if err = ch.Receive(expect); err != ErrEmpty {
+					t.Fatalf("expected ErrEmpty, got %v", err)
+				}
+			})
+		}
+	}
+}
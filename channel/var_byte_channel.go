@@ -0,0 +1,569 @@
+package channel
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"unsafe"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/webbmaffian/go-mad/internal/flock"
+	"github.com/webbmaffian/go-mad/internal/preamble"
+	"github.com/webbmaffian/go-mad/internal/utils"
+)
+
+const (
+	varPrefixSize = 4                  // Size of the length prefix of each record.
+	varAlign      = 8                  // Records start at multiples of this.
+	varWrapMarker = math.MaxUint32     // Length prefix telling that the next record is at the start.
+	varMaxItem    = math.MaxUint32 - 1 // Largest length that isn't the wrap marker.
+)
+
+// Header of a variable-length channel. The capacity is in bytes, and the item
+// size is 1.
+type varHeader struct {
+	header
+	used    int64 // Bytes used by the records, including skipped bytes.
+	maxSize int64 // Maximum item size.
+}
+
+// A byte channel of items of any size up to a maximum. Items are stored as
+// length-prefixed records in a ring buffer of a fixed number of bytes. A record
+// that doesn't fit at the end of the buffer is written at the start, after a
+// wrap marker at the end.
+type VarByteChannel struct {
+	data          mmap.MMap
+	readable      notifier // Awaited by readers, notified by writers.
+	writable      notifier // Awaited by writers, notified by readers.
+	mu            sync.Mutex
+	file          *os.File
+	head          *varHeader // Working copy of the header, committed to the store after each change.
+	store         headerStore[varHeader]
+	closed        bool
+	closedWriting bool
+}
+
+// Open or create a channel with a buffer of capacity bytes, rounded up to a
+// multiple of 8. Each record takes the size of its item plus 4 bytes, rounded
+// up to a multiple of 8, and the largest record must fit in the buffer. If the
+// file already exists, the capacity and the max item size must match the
+// values from the file.
+func NewVarByteChannel(filepath string, capacity int, maxItemSize int) (ch *VarByteChannel, err error) {
+	if maxItemSize < 1 || int64(maxItemSize) > varMaxItem {
+		return nil, errors.New("invalid max item size")
+	}
+
+	ch = &VarByteChannel{
+		head: &varHeader{
+			header:  *newHeader(int(varAlignUp(int64(capacity))), 1, preamble.KindVarChannel),
+			maxSize: int64(maxItemSize),
+		},
+	}
+
+	ch.head.headSize = int64(unsafe.Sizeof(headerSlots[varHeader]{}))
+
+	defer flock.CloseOnError(&err, &ch.file, &ch.data)
+
+	var created bool
+	info, err := os.Stat(filepath)
+
+	if err == nil {
+		if ch.file, err = os.OpenFile(filepath, os.O_RDWR, 0); err != nil {
+			return
+		}
+
+		if err = flock.Lock(ch.file, true); err != nil {
+			return
+		}
+
+		if err = ch.validateHead(info.Size()); err != nil {
+			return
+		}
+	} else if os.IsNotExist(err) {
+		if ch.head.capacity == 0 {
+			return nil, errors.New("capacity is mandatory")
+		}
+
+		if varRecordSize(ch.head.maxSize) > ch.head.capacity {
+			return nil, errors.New("capacity too small for max item size")
+		}
+
+		if ch.file, err = os.Create(filepath); err != nil {
+			return
+		}
+
+		if err = flock.Lock(ch.file, true); err != nil {
+			return
+		}
+
+		if err = ch.file.Truncate(int64(ch.head.fileSize())); err != nil {
+			return
+		}
+
+		created = true
+	} else {
+		return
+	}
+
+	if ch.data, err = mmap.Map(ch.file, mmap.RDWR, 0); err != nil {
+		return
+	}
+
+	ch.store.mapSlots(ch.data)
+
+	if created {
+		ch.store.init(ch.head)
+
+		if err = ch.Flush(); err != nil {
+			return
+		}
+	} else if !ch.store.load(ch.head) {
+		return nil, errors.New("corrupt header")
+	}
+
+	if ch.head.capacity != varAlignUp(int64(capacity)) || ch.head.maxSize != int64(maxItemSize) {
+		ch.Close()
+		return nil, errors.New("capacity and/or max item size mismatch")
+	}
+
+	// Reset statistics
+	ch.head.itemsWritten = 0
+	ch.head.itemsRead = 0
+	ch.commit()
+
+	return
+}
+
+func (ch *VarByteChannel) validateHead(fileSize int64) (err error) {
+	if fileSize < int64(ch.head.headSize) {
+		return errors.New("file too small")
+	}
+
+	if ch.file == nil {
+		return errors.New("file is not open")
+	}
+
+	if _, err = ch.file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+
+	b := make([]byte, ch.head.headSize)
+
+	if _, err = io.ReadFull(ch.file, b); err != nil {
+		return
+	}
+
+	slots := utils.BytesToPointer[headerSlots[varHeader]](b)
+
+	if err = slots[0].head.preamble.Validate(&ch.head.preamble); err != nil {
+		return
+	}
+
+	latest := slots.latest()
+
+	if latest == nil {
+		return errors.New("corrupt header")
+	}
+
+	head := &latest.head
+
+	if head.headSize != ch.head.headSize {
+		return errors.New("invalid header size")
+	}
+
+	if head.itemSize != 1 {
+		return errors.New("invalid item size")
+	}
+
+	if head.capacity < 1 || head.capacity%varAlign != 0 {
+		return errors.New("invalid capacity")
+	}
+
+	if head.maxSize < 1 || varRecordSize(head.maxSize) > head.capacity {
+		return errors.New("invalid max item size")
+	}
+
+	// Start index must be a record position within the buffer
+	if head.startIdx < 0 || head.startIdx >= head.capacity || head.startIdx%varAlign != 0 {
+		return errors.New("invalid start index")
+	}
+
+	if head.used < 0 || head.used > head.capacity {
+		return errors.New("invalid used size")
+	}
+
+	if fileSize != head.fileSize() {
+		return errors.New("invalid file size")
+	}
+
+	return
+}
+
+func (ch *VarByteChannel) WriteOrBlock(size int, cb func([]byte)) bool {
+	return ch.WriteCtx(context.Background(), size, cb) == nil
+}
+
+// Write an item of a size, blocking while there isn't space for it until the
+// context is done.
+func (ch *VarByteChannel) WriteCtx(ctx context.Context, size int, cb func([]byte)) (err error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closedWriting {
+		return ErrWritingClosed
+	}
+
+	if !ch.validSize(size) {
+		return ErrTooLarge
+	}
+
+	for !ch.fits(int64(size)) {
+		if ch.closedWriting {
+			return ErrWritingClosed
+		}
+
+		// Wait until there is space in the buffer
+		if err = ch.writable.wait(ctx, &ch.mu); err != nil {
+			return
+		}
+	}
+
+	ch.write(int64(size), cb)
+	return
+}
+
+func (ch *VarByteChannel) WriteOrFail(size int, cb func([]byte)) bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closedWriting || !ch.validSize(size) || !ch.fits(int64(size)) {
+		return false
+	}
+
+	ch.write(int64(size), cb)
+	return true
+}
+
+// Write an item of a size, replacing as many of the oldest items as needed to
+// make space for it.
+func (ch *VarByteChannel) WriteOrReplace(size int, cb func([]byte)) bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closedWriting || !ch.validSize(size) {
+		return false
+	}
+
+	// The largest record always fits in an empty buffer
+	for !ch.fits(int64(size)) {
+		ch.remove()
+	}
+
+	ch.write(int64(size), cb)
+	return true
+}
+
+func (ch *VarByteChannel) validSize(size int) bool {
+	return size >= 0 && int64(size) <= ch.head.maxSize
+}
+
+// Whether there is space for a record of a size at the end, including any
+// bytes skipped at the end of the buffer.
+func (ch *VarByteChannel) fits(size int64) bool {
+	n := varRecordSize(size)
+
+	if tail := ch.tail(); tail+n > ch.head.capacity {
+		n += ch.head.capacity - tail
+	}
+
+	return ch.head.used+n <= ch.head.capacity
+}
+
+func (ch *VarByteChannel) write(size int64, cb func([]byte)) {
+	tail := ch.tail()
+	n := varRecordSize(size)
+
+	// Skip the rest of the buffer if the record doesn't fit before the end
+	if tail+n > ch.head.capacity {
+		binary.LittleEndian.PutUint32(ch.at(tail), varWrapMarker)
+		ch.head.used += ch.head.capacity - tail
+		tail = 0
+	}
+
+	binary.LittleEndian.PutUint32(ch.at(tail), uint32(size))
+	cb(ch.record(tail, size))
+
+	ch.head.used += n
+	ch.head.length++
+	ch.head.itemsWritten++
+	ch.commit()
+	ch.readable.broadcast()
+}
+
+func (ch *VarByteChannel) Wait() (ok bool) {
+	return ch.WaitCtx(context.Background()) == nil
+}
+
+// Wait until there is anything to read, or until the context is done.
+func (ch *VarByteChannel) WaitCtx(ctx context.Context) (err error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	// Wait until there is data in the buffer to read
+	for ch.empty() {
+
+		// If writing is closed, there will never be any more to read
+		if ch.closedWriting {
+			return ErrWritingClosed
+		}
+
+		if err = ch.readable.wait(ctx, &ch.mu); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (ch *VarByteChannel) ReadToCallback(cb func([]byte) error, undoOnError bool) (err error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return ErrClosed
+	}
+
+	// If there is nothing to read, fail
+	if ch.empty() {
+		return ErrEmpty
+	}
+
+	pos, size, _ := ch.first()
+	err = cb(ch.record(pos, size))
+
+	if undoOnError && err != nil {
+		return
+	}
+
+	ch.remove()
+	ch.head.itemsRead++
+	ch.commit()
+	ch.writable.broadcast()
+	return
+}
+
+// Call the callback with the next item without reading it. The slice is only
+// valid until the callback returns.
+func (ch *VarByteChannel) Peek(cb func([]byte) error) (err error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return ErrClosed
+	}
+
+	// If there is nothing to read, fail
+	if ch.empty() {
+		return ErrEmpty
+	}
+
+	pos, size, _ := ch.first()
+	return cb(ch.record(pos, size))
+}
+
+// Wait until the channel is empty, or until the context is done.
+func (ch *VarByteChannel) WaitUntilEmptyCtx(ctx context.Context) (err error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	for !ch.empty() && !ch.closed {
+		if err = ch.writable.wait(ctx, &ch.mu); err != nil {
+			return
+		}
+	}
+
+	if ch.closed {
+		return ErrClosed
+	}
+
+	return
+}
+
+// Position and size of the first record, and the number of bytes skipped at
+// the end of the buffer before it.
+func (ch *VarByteChannel) first() (pos int64, size int64, skipped int64) {
+	pos = ch.head.startIdx
+
+	if binary.LittleEndian.Uint32(ch.at(pos)) == varWrapMarker {
+		skipped = ch.head.capacity - pos
+		pos = 0
+	}
+
+	size = int64(binary.LittleEndian.Uint32(ch.at(pos)))
+	return
+}
+
+// Remove the first record without committing.
+func (ch *VarByteChannel) remove() {
+	pos, size, skipped := ch.first()
+	n := varRecordSize(size)
+
+	ch.head.startIdx = (pos + n) % ch.head.capacity
+	ch.head.used -= skipped + n
+	ch.head.length--
+
+	// Start over from the beginning when empty, to avoid wrapping
+	if ch.head.length == 0 {
+		ch.head.startIdx = 0
+		ch.head.used = 0
+	}
+}
+
+func (ch *VarByteChannel) commit() {
+	ch.store.commit(ch.head)
+}
+
+func (ch *VarByteChannel) Flush() error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.flush()
+}
+
+func (ch *VarByteChannel) flush() error {
+	return ch.data.Flush()
+}
+
+func (ch *VarByteChannel) CloseWriting() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if !ch.closedWriting {
+		ch.closedWriting = true
+		ch.readable.broadcast()
+		ch.writable.broadcast()
+	}
+}
+
+func (ch *VarByteChannel) Close() (err error) {
+	ch.CloseWriting()
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return
+	}
+
+	ch.closed = true
+	ch.closedWriting = true
+	ch.readable.broadcast()
+	ch.writable.broadcast()
+
+	if err = ch.flush(); err != nil {
+		return
+	}
+
+	// The mapping must be released for the lock of the file to be released
+	if err = ch.data.Unmap(); err != nil {
+		return
+	}
+
+	return ch.file.Close()
+}
+
+func (ch *VarByteChannel) Empty() bool {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.empty()
+}
+
+func (ch *VarByteChannel) empty() bool {
+	return ch.head.length <= 0
+}
+
+// Number of items in the channel.
+func (ch *VarByteChannel) Len() int64 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.head.length
+}
+
+// Size of the buffer in bytes.
+func (ch *VarByteChannel) Cap() int64 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.head.capacity
+}
+
+// Number of bytes used in the buffer, including length prefixes and padding.
+func (ch *VarByteChannel) Used() int64 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.head.used
+}
+
+func (ch *VarByteChannel) MaxItemSize() int64 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.head.maxSize
+}
+
+func (ch *VarByteChannel) Reset() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.head.startIdx = 0
+	ch.head.length = 0
+	ch.head.used = 0
+	ch.commit()
+	ch.writable.broadcast()
+}
+
+func (ch *VarByteChannel) ItemsWritten() uint64 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.head.itemsWritten
+}
+
+func (ch *VarByteChannel) ItemsRead() uint64 {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	return ch.head.itemsRead
+}
+
+// Position after the last record.
+func (ch *VarByteChannel) tail() int64 {
+	return (ch.head.startIdx + ch.head.used) % ch.head.capacity
+}
+
+func (ch *VarByteChannel) at(pos int64) []byte {
+	pos += ch.head.headSize
+	return ch.data[pos : pos+varPrefixSize]
+}
+
+func (ch *VarByteChannel) record(pos int64, size int64) []byte {
+	pos += ch.head.headSize + varPrefixSize
+	return ch.data[pos : pos+size : pos+size]
+}
+
+// Size of a record with an item of a size, including its length prefix and
+// padding.
+func varRecordSize(size int64) int64 {
+	return varAlignUp(varPrefixSize + size)
+}
+
+func varAlignUp(n int64) int64 {
+	return (n + varAlign - 1) / varAlign * varAlign
+}
@@ -0,0 +1,106 @@
+package channel
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestVarByteChannel(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []int // Sizes of the items written before reading.
+		reads  int
+		more   []int // Sizes of the items written after reading.
+		moreOk []bool
+	}{
+		{"small", []int{1, 2, 3}, 1, []int{4}, []bool{true}},
+		{"wrapped", []int{20, 20}, 1, []int{20}, []bool{true}},
+		{"full", []int{20, 20}, 0, []int{20, 0}, []bool{false, true}},
+		{"too large", nil, 0, []int{21}, []bool{false}},
+		{"empty item", []int{0, 5}, 0, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ch")
+			ch, err := NewVarByteChannel(path, 64, 20)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Items left in the channel, each filled with its index
+			var want [][]byte
+			var written int
+
+			write := func(size int) bool {
+				item := bytes.Repeat([]byte{byte(written)}, size)
+
+				if !ch.WriteOrFail(size, func(b []byte) { copy(b, item) }) {
+					return false
+				}
+
+				want = append(want, item)
+				written++
+				return true
+			}
+
+			read := func() {
+				if err := ch.ReadToCallback(func(b []byte) error {
+					if !bytes.Equal(b, want[0]) {
+						t.Fatalf("expected %v, got %v", want[0], b)
+					}
+
+					return nil
+				}, false); err != nil {
+					t.Fatal(err)
+				}
+
+				want = want[1:]
+			}
+
+			for _, size := range tt.writes {
+				if !write(size) {
+					t.Fatalf("failed to write %d bytes", size)
+				}
+			}
+
+			for i := 0; i < tt.reads; i++ {
+				read()
+			}
+
+			for i, size := range tt.more {
+				if ok := write(size); ok != tt.moreOk[i] {
+					t.Fatalf("write of %d bytes: expected %v, got %v", size, tt.moreOk[i], ok)
+				}
+			}
+
+			if err = ch.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = NewVarByteChannel(path, 64, 10); err == nil {
+				t.Fatal("expected error when reopening with another max item size")
+			}
+
+			if ch, err = NewVarByteChannel(path, 64, 20); err != nil {
+				t.Fatal(err)
+			}
+
+			defer ch.Close()
+
+			if l := ch.Len(); l != int64(len(want)) {
+				t.Fatalf("expected length %d after reopening, got %d", len(want), l)
+			}
+
+			for len(want) > 0 {
+				read()
+			}
+
+			if !ch.Empty() || ch.Used() != 0 {
+				t.Fatalf("expected an empty channel, got %d bytes used", ch.Used())
+			}
+		})
+	}
+}
@@ -2,10 +2,12 @@ module github.com/webbmaffian/go-mad
 
 go 1.19
 
-require github.com/edsrzf/mmap-go v1.1.0
+require (
+	github.com/edsrzf/mmap-go v1.1.0
+	golang.org/x/sys v0.6.0
+)
 
 require (
 	github.com/gosuri/uilive v0.0.4 // indirect
 	github.com/mattn/go-isatty v0.0.19 // indirect
-	golang.org/x/sys v0.6.0 // indirect
 )
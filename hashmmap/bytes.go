@@ -0,0 +1,206 @@
+package hashmmap
+
+import (
+	"bytes"
+
+	"github.com/webbmaffian/go-mad/arena"
+)
+
+// Suffix of the companion file that holds the keys of a Bytes hashmap.
+const keysSuffix = ".keys"
+
+type bytesEntry[V any] struct {
+	key arena.Handle
+	val V
+}
+
+// Initialize a new memory-mapped hashmap with arbitrary byte keys. Keys are
+// stored in a companion file next to the hashmap, with the ".keys" suffix.
+// The provided value type (`V`) MUST NOT contain any pointer nor slice.
+func NewBytes[V any](filepath string, capacity ...uint64) (m *Bytes[V], err error) {
+	m = new(Bytes[V])
+
+	if m.raw, err = NewRawWithHasher[uint64, bytesEntry[V]](filepath, IdentityHasher[uint64]{}, capacity...); err != nil {
+		return
+	}
+
+	if m.keys, err = arena.New(filepath + keysSuffix); err != nil {
+		m.raw.Close()
+		return nil, err
+	}
+
+	return
+}
+
+func OpenBytesRO[V any](filepath string) (m *Bytes[V], err error) {
+	m = new(Bytes[V])
+
+	if m.raw, err = OpenRawROWithHasher[uint64, bytesEntry[V]](filepath, IdentityHasher[uint64]{}); err != nil {
+		return
+	}
+
+	if m.keys, err = arena.OpenRO(filepath + keysSuffix); err != nil {
+		m.raw.Close()
+		return nil, err
+	}
+
+	return
+}
+
+// Memory-mapped hashmap with byte keys. Keys are hashed into a Raw hashmap,
+// and compared in full on lookup, so that hash collisions are resolved.
+type Bytes[V any] struct {
+	raw  *Raw[uint64, bytesEntry[V]]
+	keys *arena.Arena
+}
+
+func (m *Bytes[V]) Flush() (err error) {
+	if err = m.raw.Flush(); err != nil {
+		return
+	}
+
+	return m.keys.Flush()
+}
+
+func (m *Bytes[V]) Close() (err error) {
+	if err = m.raw.Close(); err != nil {
+		return
+	}
+
+	return m.keys.Close()
+}
+
+func (m *Bytes[V]) Cap() int {
+	return m.raw.Cap()
+}
+
+func (m *Bytes[V]) Len() int {
+	return m.raw.Len()
+}
+
+// See Raw.SetGrowthFactor.
+func (m *Bytes[V]) SetGrowthFactor(factor float64) {
+	m.raw.SetGrowthFactor(factor)
+}
+
+// See Raw.SetMaxLoadFactor.
+func (m *Bytes[V]) SetMaxLoadFactor(factor float64) {
+	m.raw.SetMaxLoadFactor(factor)
+}
+
+func (m *Bytes[V]) Has(key []byte) bool {
+	return m.Find(key) != nil
+}
+
+func (m *Bytes[V]) Get(key []byte) (val V, ok bool) {
+	if v := m.Find(key); v != nil {
+		return *v, true
+	}
+
+	return
+}
+
+// Find the value of a key in place, or nil if the key doesn't exist.
+func (m *Bytes[V]) Find(key []byte) *V {
+	f := m.raw.Find(hashBytes(key))
+
+	for f.Next() {
+		if m.keyEquals(&f.link.Val, key) {
+			return &f.link.Val.val
+		}
+	}
+
+	return nil
+}
+
+// Set the value of a key, and return whether an existing value was replaced.
+func (m *Bytes[V]) Put(key []byte, val V) (replaced bool, err error) {
+	if m.raw.readonly {
+		return false, errReadOnly
+	}
+
+	if v := m.Find(key); v != nil {
+		*v = val
+		return true, nil
+	}
+
+	h, err := m.keys.Append(key)
+
+	if err != nil {
+		return
+	}
+
+	if err = m.raw.Add(hashBytes(key), bytesEntry[V]{key: h, val: val}); err != nil {
+		m.keys.Free(h)
+	}
+
+	return
+}
+
+// Delete a key, and return whether it existed. The space of the key is
+// reclaimed on the next compaction.
+func (m *Bytes[V]) Delete(key []byte) (deleted bool, err error) {
+	count, err := m.raw.DeleteFunc(hashBytes(key), func(e *bytesEntry[V]) (ok bool) {
+		if ok = m.keyEquals(e, key); ok {
+			m.keys.Free(e.key)
+		}
+
+		return
+	})
+
+	return count > 0, err
+}
+
+// Reclaim the space of deleted keys in the companion file.
+func (m *Bytes[V]) Compact() error {
+	return m.keys.Compact(func(yield func(h *arena.Handle)) error {
+		iter := m.raw.Iterate()
+
+		for iter.Next() {
+			yield(&iter.Val().key)
+		}
+
+		return nil
+	})
+}
+
+func (m *Bytes[V]) Iterate() BytesIterator[V] {
+	return BytesIterator[V]{
+		iter: m.raw.Iterate(),
+		keys: m.keys,
+	}
+}
+
+func (m *Bytes[V]) keyEquals(e *bytesEntry[V], key []byte) bool {
+	return e.key.Len() == len(key) && bytes.Equal(m.keys.Get(e.key), key)
+}
+
+type BytesIterator[V any] struct {
+	iter Iterator[uint64, bytesEntry[V]]
+	keys *arena.Arena
+}
+
+func (iter *BytesIterator[V]) Next() bool {
+	return iter.iter.Next()
+}
+
+// The returned key MUST NOT be modified.
+func (iter *BytesIterator[V]) Key() []byte {
+	return iter.keys.Get(iter.iter.Val().key)
+}
+
+func (iter *BytesIterator[V]) Val() *V {
+	return &iter.iter.Val().val
+}
+
+// 64-bit FNV-1a
+func hashBytes(b []byte) (h uint64) {
+	h = 14695981039346656037
+
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+
+	return
+}
@@ -0,0 +1,179 @@
+package hashmmap
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type bytesOp struct {
+	del bool
+	key string
+	val uint64
+}
+
+func checkBytes(t *testing.T, m *Bytes[uint64], want map[string]uint64) {
+	t.Helper()
+
+	if l := m.Len(); l != len(want) {
+		t.Fatalf("expected length %d, got %d", len(want), l)
+	}
+
+	for key, val := range want {
+		if v, ok := m.Get([]byte(key)); !ok || v != val {
+			t.Fatalf("key %.10q: expected %d, got %d (%v)", key, val, v, ok)
+		}
+	}
+
+	seen := make(map[string]bool)
+	iter := m.Iterate()
+
+	for iter.Next() {
+		key := string(iter.Key())
+
+		if val, ok := want[key]; !ok || seen[key] || *iter.Val() != val {
+			t.Fatalf("unexpected entry %.10q: %d", key, *iter.Val())
+		}
+
+		seen[key] = true
+	}
+}
+
+func TestBytes(t *testing.T) {
+	long := strings.Repeat("x", 5000)
+
+	tests := []struct {
+		name string
+		ops  []bytesOp
+		want map[string]uint64
+	}{
+		{"put", []bytesOp{{false, "a", 1}, {false, "b", 2}}, map[string]uint64{"a": 1, "b": 2}},
+		{"replace", []bytesOp{{false, "a", 1}, {false, "a", 2}}, map[string]uint64{"a": 2}},
+		{"prefix", []bytesOp{{false, "ab", 1}, {false, "a", 2}, {false, "abc", 3}}, map[string]uint64{"ab": 1, "a": 2, "abc": 3}},
+		{"empty key", []bytesOp{{false, "", 1}, {false, "a", 2}}, map[string]uint64{"": 1, "a": 2}},
+		{"delete", []bytesOp{{false, "a", 1}, {false, "b", 2}, {true, "a", 0}}, map[string]uint64{"b": 2}},
+		{"delete missing", []bytesOp{{false, "a", 1}, {true, "b", 0}}, map[string]uint64{"a": 1}},
+		{"put after delete", []bytesOp{{false, "a", 1}, {true, "a", 0}, {false, "a", 3}}, map[string]uint64{"a": 3}},
+		{"long key", []bytesOp{{false, "a", 1}, {false, long, 2}}, map[string]uint64{"a": 1, long: 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "map")
+			m, err := NewBytes[uint64](path, 8)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, o := range tt.ops {
+				if o.del {
+					m.Delete([]byte(o.key))
+				} else if _, err = m.Put([]byte(o.key), o.val); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			checkBytes(t, m, tt.want)
+
+			if m.Has([]byte("missing")) {
+				t.Fatal("expected a missing key not to exist")
+			}
+
+			if err = m.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if m, err = NewBytes[uint64](path, 8); err != nil {
+				t.Fatal(err)
+			}
+
+			defer m.Close()
+
+			checkBytes(t, m, tt.want)
+		})
+	}
+}
+
+func TestBytesCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "map")
+	m, err := NewBytes[uint64](path, 8)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]uint64{"alpha": 1, "gamma": 3}
+
+	for key, val := range map[string]uint64{"alpha": 1, "beta": 2, "gamma": 3, "delta": 4} {
+		if _, err = m.Put([]byte(key), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.Delete([]byte("beta"))
+	m.Delete([]byte("delta"))
+
+	if g := m.keys.Garbage(); g != len("beta")+len("delta") {
+		t.Fatalf("expected %d bytes of garbage, got %d", len("beta")+len("delta"), g)
+	}
+
+	if err = m.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, g := m.keys.Len(), m.keys.Garbage(); l != len("alpha")+len("gamma") || g != 0 {
+		t.Fatalf("expected %d bytes without garbage, got %d with %d bytes of garbage", len("alpha")+len("gamma"), l, g)
+	}
+
+	checkBytes(t, m, want)
+
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err = NewBytes[uint64](path, 8); err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	checkBytes(t, m, want)
+}
+
+func TestBytesReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "map")
+	m, err := NewBytes[uint64](path, 8)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = m.Put([]byte("a"), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m, err = OpenBytesRO[uint64](path); err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	if _, err = m.Put([]byte("a"), 2); err == nil {
+		t.Fatal("expected error when replacing")
+	}
+
+	if _, err = m.Put([]byte("b"), 2); err == nil {
+		t.Fatal("expected error when adding")
+	}
+
+	if _, err = m.Delete([]byte("a")); err == nil {
+		t.Fatal("expected error when deleting")
+	}
+
+	checkBytes(t, m, map[string]uint64{"a": 1})
+}
@@ -15,8 +15,13 @@ func main() {
 
 	defer m.Close()
 
-	m.Add(123, 456)
-	m.Add(123, 789)
+	if err = m.Add(123, 456); err != nil {
+		log.Fatal(err)
+	}
+
+	if err = m.Add(123, 789); err != nil {
+		log.Fatal(err)
+	}
 
 	log.Println(m.Len(), "items")
 
@@ -3,25 +3,30 @@ package hashmmap
 import "github.com/webbmaffian/go-mad/internal/utils"
 
 type Finder[K utils.Unsigned, V any] struct {
-	raw     *Raw[K, V]
-	link    *Link[K, V]
-	key     K
-	nextIdx K
+	raw        *Raw[K, V]
+	link       *Link[K, V]
+	key        K
+	nextIdx    K
+	pendingIdx K // Chain to continue with once the current is exhausted.
 }
 
 func (iter *Finder[K, V]) Next() bool {
-	if iter.nextIdx == 0 {
-		return false
-	}
+	for {
+		if iter.nextIdx == 0 {
+			if iter.pendingIdx == 0 {
+				return false
+			}
 
-	iter.link = iter.raw.getLinkAtIndex(iter.nextIdx)
-	iter.nextIdx = iter.link.NextIdx
+			iter.nextIdx, iter.pendingIdx = iter.pendingIdx, 0
+		}
 
-	if iter.link.Key != iter.key {
-		return iter.Next()
-	}
+		iter.link = iter.raw.getLinkAtIndex(iter.nextIdx)
+		iter.nextIdx = iter.link.NextIdx
 
-	return true
+		if iter.link.Key == iter.key {
+			return true
+		}
+	}
 }
 
 func (iter *Finder[K, V]) Key() K {
@@ -0,0 +1,63 @@
+package hashmmap
+
+import (
+	"math/bits"
+
+	"github.com/webbmaffian/go-mad/internal/utils"
+)
+
+var (
+	_ Hasher[uint64] = IdentityHasher[uint64]{}
+	_ Hasher[uint64] = FibonacciHasher[uint64]{}
+	_ Hasher[uint64] = MixHasher[uint64]{}
+)
+
+// A hasher distributes keys over the buckets. Its ID is stored in the file, so
+// that a file can't be opened with another hasher than it was created with.
+// IDs below 128 are reserved for the built-in hashers.
+type Hasher[K utils.Unsigned] interface {
+	ID() uint8
+	Hash(key K) K
+}
+
+// Uses the key as-is. Suitable for keys that are already evenly distributed.
+type IdentityHasher[K utils.Unsigned] struct{}
+
+func (IdentityHasher[K]) ID() uint8 {
+	return 0
+}
+
+func (IdentityHasher[K]) Hash(key K) K {
+	return key
+}
+
+// Multiplies the key with the golden ratio and keeps the high bits. Cheap, and
+// spreads sequential keys well. The bits are reversed, as the hash is reduced
+// to a bucket by its low bits - which are the least mixed bits of the product.
+type FibonacciHasher[K utils.Unsigned] struct{}
+
+func (FibonacciHasher[K]) ID() uint8 {
+	return 1
+}
+
+func (FibonacciHasher[K]) Hash(key K) K {
+	return K(bits.Reverse64(uint64(key) * 11400714819323198485))
+}
+
+// Mixes all bits of the key like the final avalanche of xxHash. Suitable for
+// keys with common low bits.
+type MixHasher[K utils.Unsigned] struct{}
+
+func (MixHasher[K]) ID() uint8 {
+	return 2
+}
+
+func (MixHasher[K]) Hash(key K) K {
+	h := uint64(key)
+	h ^= h >> 33
+	h *= 14029467366897019727
+	h ^= h >> 29
+	h *= 1609587929392839161
+	h ^= h >> 32
+	return K(h)
+}
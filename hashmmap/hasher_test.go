@@ -0,0 +1,63 @@
+package hashmmap
+
+import "testing"
+
+// Number of buckets that a hasher spreads keys over.
+func usedBuckets[K uint32 | uint64](h Hasher[K], keys []K, buckets K) int {
+	used := make(map[K]bool)
+
+	for _, key := range keys {
+		used[h.Hash(key)%buckets] = true
+	}
+
+	return len(used)
+}
+
+func TestHasherDistribution(t *testing.T) {
+	tests := []struct {
+		name     string
+		step     uint64 // Distance between keys.
+		identity bool   // Whether the identity hasher spreads the keys too.
+	}{
+		{"sequential", 1, true},
+		{"multiples of 1024", 1024, false},
+		{"multiples of 2^32", 1 << 32, false},
+	}
+
+	const n, buckets = 1000, 1024
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := make([]uint64, n)
+
+			for i := range keys {
+				keys[i] = uint64(i) * tt.step
+			}
+
+			// Random keys would be spread over about 640 buckets
+			for _, h := range []Hasher[uint64]{FibonacciHasher[uint64]{}, MixHasher[uint64]{}} {
+				if used := usedBuckets(h, keys, buckets); used < 500 {
+					t.Fatalf("hasher %d: expected at least 500 buckets, got %d", h.ID(), used)
+				}
+			}
+
+			if used := usedBuckets[uint64](IdentityHasher[uint64]{}, keys, buckets); (used >= 500) != tt.identity {
+				t.Fatalf("identity hasher: unexpected %d buckets", used)
+			}
+
+			if tt.step > 1<<20 {
+				return
+			}
+
+			keys32 := make([]uint32, n)
+
+			for i := range keys32 {
+				keys32[i] = uint32(keys[i])
+			}
+
+			if used := usedBuckets[uint32](FibonacciHasher[uint32]{}, keys32, buckets); used < 500 {
+				t.Fatalf("expected at least 500 buckets with 32-bit keys, got %d", used)
+			}
+		})
+	}
+}
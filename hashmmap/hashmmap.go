@@ -6,14 +6,45 @@ import (
 	"os"
 
 	"github.com/edsrzf/mmap-go"
+	"github.com/webbmaffian/go-mad/internal/flock"
 	"github.com/webbmaffian/go-mad/internal/utils"
 )
 
+var ErrFull = errors.New("hashmap is full")
+
+var errReadOnly = errors.New("hashmap is read-only")
+
+// Smallest growth factor used when growing automatically. Every grow keeps the
+// previous mapping until the hashmap is closed, so the number of mappings must
+// grow logarithmically with the capacity.
+const minGrowth = 1.125
+
+// Files are locked while open - exclusively when opened for writing, otherwise
+// shared. Opening a file that is locked by another process fails with
+// ErrLocked.
+const ErrLocked = flock.ErrLocked
+
+// Initialize a new memory-mapped hashmap with a filepath and capacity. The
+// provided value type (`V`) MUST NOT contain any pointer nor slice, which is
+// validated on open.
 func NewRaw[K utils.Unsigned, V any](filepath string, capacity ...K) (m *Raw[K, V], err error) {
+	return NewRawWithHasher[K, V](filepath, IdentityHasher[K]{}, capacity...)
+}
+
+// Initialize a new memory-mapped hashmap that distributes keys with the provided
+// hasher. An existing file must have been created with the same hasher.
+func NewRawWithHasher[K utils.Unsigned, V any](filepath string, hasher Hasher[K], capacity ...K) (m *Raw[K, V], err error) {
+	if err = utils.ValidatePlain[V](); err != nil {
+		return nil, err
+	}
+
 	m = &Raw[K, V]{
-		head: newHashmmapHeader[K, V](),
+		head:   newHashmmapHeader[K, V](),
+		hasher: hasher,
 	}
 
+	m.head.hasher = K(hasher.ID())
+
 	if m.head.valSize == 0 {
 		return nil, errors.New("value must be at least 1 byte")
 	}
@@ -26,6 +57,10 @@ func NewRaw[K utils.Unsigned, V any](filepath string, capacity ...K) (m *Raw[K,
 		}
 	}
 
+	m.head.layout()
+
+	defer flock.CloseOnError(&err, &m.file, &m.data)
+
 	var created bool
 	info, err := os.Stat(filepath)
 
@@ -34,15 +69,27 @@ func NewRaw[K utils.Unsigned, V any](filepath string, capacity ...K) (m *Raw[K,
 			return
 		}
 
+		if err = flock.Lock(m.file, true); err != nil {
+			return
+		}
+
 		if err = m.validateHead(info.Size()); err != nil {
 			return
 		}
+
+		if err = m.trim(info.Size()); err != nil {
+			return
+		}
 	} else if os.IsNotExist(err) {
 		if m.file, err = os.Create(filepath); err != nil {
 			return
 		}
 
-		if err = m.file.Truncate(int64(m.head.fileSize())); err != nil {
+		if err = flock.Lock(m.file, true); err != nil {
+			return
+		}
+
+		if err = m.file.Truncate(int64(m.head.size)); err != nil {
 			return
 		}
 
@@ -67,19 +114,33 @@ func NewRaw[K utils.Unsigned, V any](filepath string, capacity ...K) (m *Raw[K,
 
 	m.head = utils.BytesToPointer[hashmmapHeader[K]](m.data[:m.head.headSize])
 	m.setKeyed()
+	m.resumeMigration()
 
 	return
 }
 
 func OpenRawRO[K utils.Unsigned, V any](filepath string) (m *Raw[K, V], err error) {
+	return OpenRawROWithHasher[K, V](filepath, IdentityHasher[K]{})
+}
+
+func OpenRawROWithHasher[K utils.Unsigned, V any](filepath string, hasher Hasher[K]) (m *Raw[K, V], err error) {
+	if err = utils.ValidatePlain[V](); err != nil {
+		return nil, err
+	}
+
 	m = &Raw[K, V]{
-		head: newHashmmapHeader[K, V](),
+		head:   newHashmmapHeader[K, V](),
+		hasher: hasher,
 	}
 
+	m.head.hasher = K(hasher.ID())
+
 	if m.head.valSize == 0 {
 		return nil, errors.New("value must be at least 1 byte")
 	}
 
+	defer flock.CloseOnError(&err, &m.file, &m.data)
+
 	info, err := os.Stat(filepath)
 
 	if err != nil {
@@ -90,6 +151,10 @@ func OpenRawRO[K utils.Unsigned, V any](filepath string) (m *Raw[K, V], err erro
 		return
 	}
 
+	if err = flock.Lock(m.file, false); err != nil {
+		return
+	}
+
 	if err = m.validateHead(info.Size()); err != nil {
 		return
 	}
@@ -100,16 +165,60 @@ func OpenRawRO[K utils.Unsigned, V any](filepath string) (m *Raw[K, V], err erro
 
 	m.head = utils.BytesToPointer[hashmmapHeader[K]](m.data[:m.head.headSize])
 	m.setKeyed()
+	m.readonly = true
 
 	return
 }
 
 // Memory-mapped hashmap
 type Raw[K utils.Unsigned, V any] struct {
-	data  mmap.MMap
-	file  *os.File
-	head  *hashmmapHeader[K]
-	keyed bool
+	data     mmap.MMap
+	file     *os.File
+	head     *hashmmapHeader[K]
+	hasher   Hasher[K]
+	stale    []mmap.MMap // Previous mappings, kept alive until the hashmap is closed.
+	maxLoad  float64
+	growth   float64
+	keyed    bool
+	readonly bool
+}
+
+// Accept the current layout of the value type (`V`) for an existing file,
+// after an intentional change of the type that keeps its size. Any data that
+// doesn't match the new layout will be garbage.
+func ResetRawFingerprint[K utils.Unsigned, V any](filepath string) (err error) {
+	expected := newHashmmapHeader[K, V]()
+	f, err := os.OpenFile(filepath, os.O_RDWR, 0)
+
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	if err = flock.Lock(f, true); err != nil {
+		return
+	}
+
+	b := make([]byte, expected.headSize)
+
+	if _, err = f.ReadAt(b, 0); err != nil {
+		return
+	}
+
+	head := utils.BytesToPointer[hashmmapHeader[K]](b)
+
+	if err = head.preamble.Validate(&expected.preamble); err != nil {
+		return
+	}
+
+	if head.headSize != expected.headSize || head.keySize != expected.keySize || head.valSize != expected.valSize {
+		return errors.New("invalid key and/or value size")
+	}
+
+	head.fingerprint = expected.fingerprint
+	_, err = f.WriteAt(b, 0)
+	return
 }
 
 func (m *Raw[K, V]) setKeyed() {
@@ -140,6 +249,10 @@ func (m *Raw[K, V]) validateHead(fileSize int64) (err error) {
 
 	head := utils.BytesToPointer[hashmmapHeader[K]](b)
 
+	if err = head.preamble.Validate(&m.head.preamble); err != nil {
+		return
+	}
+
 	if head.keySize != m.head.keySize {
 		return errors.New("invalid key size")
 	}
@@ -148,18 +261,44 @@ func (m *Raw[K, V]) validateHead(fileSize int64) (err error) {
 		return errors.New("invalid value size")
 	}
 
+	if head.hasher != m.head.hasher {
+		return errors.New("invalid hasher")
+	}
+
+	if head.fingerprint != m.head.fingerprint {
+		return errors.New("invalid fingerprint - the layout of the value type has changed")
+	}
+
 	// A capacity can never me less than the length
 	if head.capacity < head.length {
 		return errors.New("invalid capacity")
 	}
 
-	if fileSize != int64(head.fileSize()) {
+	// A larger file is left by an extension that was interrupted before the
+	// size was updated
+	if fileSize < int64(head.size) {
 		return errors.New("invalid file size")
 	}
 
 	return
 }
 
+// Truncate the file to the size in the header, after an extension that was
+// interrupted before the size was updated.
+func (m *Raw[K, V]) trim(fileSize int64) (err error) {
+	b := make([]byte, m.head.headSize)
+
+	if _, err = m.file.ReadAt(b, 0); err != nil {
+		return
+	}
+
+	if size := int64(utils.BytesToPointer[hashmmapHeader[K]](b).size); fileSize > size {
+		err = m.file.Truncate(size)
+	}
+
+	return
+}
+
 func (m *Raw[K, V]) Flush() error {
 	return m.data.Flush()
 }
@@ -169,6 +308,14 @@ func (m *Raw[K, V]) Close() (err error) {
 		return
 	}
 
+	for _, data := range m.stale {
+		if err = data.Unmap(); err != nil {
+			return
+		}
+	}
+
+	m.stale = nil
+
 	return m.file.Close()
 }
 
@@ -210,11 +357,20 @@ func (m *Raw[K, V]) Get(key K) (val V, ok bool) {
 }
 
 func (m *Raw[K, V]) Find(key K) Finder[K, V] {
-	return Finder[K, V]{
+	f := Finder[K, V]{
 		raw:     m,
 		key:     key,
 		nextIdx: *m.getIndexAtIndex(m.getBucketIdx(m.getBucket(key))),
 	}
+
+	// While rehashing, entries might still remain in the previous bucket index.
+	// These are older, and are therefore found first.
+	if m.head.oldBuckets != 0 {
+		f.pendingIdx = f.nextIdx
+		f.nextIdx = *m.getIndexAtIndex(m.getOldBucketIdx(m.getOldBucket(key)))
+	}
+
+	return f
 }
 
 func (m *Raw[K, V]) Iterate() Iterator[K, V] {
@@ -224,12 +380,156 @@ func (m *Raw[K, V]) Iterate() Iterator[K, V] {
 	}
 }
 
-func (m *Raw[K, V]) Add(key K, val V) {
+// Add an entry. If the hashmap is full and can't grow, ErrFull is returned.
+func (m *Raw[K, V]) Add(key K, val V) (err error) {
+	if m.readonly {
+		return errReadOnly
+	}
+
+	m.rehashStep(key)
 	idx := m.getAvailableIndex()
+
+	if idx == 0 {
+		if err = m.grow(); err != nil {
+			return
+		}
+
+		idx = m.getAvailableIndex()
+	}
+
 	link := m.getLinkAtIndex(idx)
 	link.Key, link.Val, link.NextIdx = key, val, 0
 	*m.findLeafIdx(key) = idx
 	m.head.length++
+
+	if m.overloaded() {
+		// A failed rehash only means longer chains, so there is nothing to handle.
+		_ = m.Rehash(m.head.buckets * 2)
+	}
+
+	return
+}
+
+// Replace the value of the first entry with the key, or add a new entry if
+// there is none. Returns whether an existing entry was replaced.
+func (m *Raw[K, V]) Put(key K, val V) (replaced bool, err error) {
+	if m.readonly {
+		return false, errReadOnly
+	}
+
+	f := m.Find(key)
+
+	if f.Next() {
+		f.link.Val = val
+		return true, nil
+	}
+
+	return false, m.Add(key, val)
+}
+
+// Let the hashmap grow automatically when adding to a full hashmap. The new
+// capacity will be the current capacity multiplied by the factor (but always
+// at least one more). Factors below 1.125 grow by 1.125, as every grow keeps a
+// mapping until the hashmap is closed. A factor of 1 or less disables growth,
+// which is the default.
+func (m *Raw[K, V]) SetGrowthFactor(factor float64) {
+	m.growth = factor
+}
+
+// Grow the hashmap to a new capacity by extending the file and mapping it
+// again. As links refer to each other by their position in the file, all
+// existing entries stay where they are. Values returned by Find, Iterate and
+// Get before the grow stay valid until the hashmap is closed, as the previous
+// mapping is kept alive.
+func (m *Raw[K, V]) Grow(capacity K) (err error) {
+	if capacity <= m.head.capacity {
+		return errors.New("capacity must be greater than current capacity")
+	}
+
+	idx, err := m.extend((capacity - m.head.capacity) * m.head.linkSize)
+
+	if err != nil {
+		return
+	}
+
+	// Keep any links that were never used before moving on to the new region
+	for m.head.tailIdx+m.head.linkSize <= m.head.endIdx {
+		m.freeUnusedLink(m.head.tailIdx)
+		m.head.tailIdx += m.head.linkSize
+	}
+
+	m.head.tailIdx, m.head.endIdx = idx, idx+(capacity-m.head.capacity)*m.head.linkSize
+	m.head.capacity = capacity
+
+	return
+}
+
+func (m *Raw[K, V]) grow() error {
+	if m.growth <= 1 {
+		return ErrFull
+	}
+
+	factor := m.growth
+
+	if factor < minGrowth {
+		factor = minGrowth
+	}
+
+	capacity := K(float64(m.head.capacity) * factor)
+
+	if capacity <= m.head.capacity {
+		capacity = m.head.capacity + 1
+	}
+
+	return m.Grow(capacity)
+}
+
+// Delete all entries with the key, and return the number of deleted entries.
+func (m *Raw[K, V]) Delete(key K) (count int, err error) {
+	return m.DeleteFunc(key, func(*V) bool {
+		return true
+	})
+}
+
+// Delete all entries with the key for which the predicate returns true, and
+// return the number of deleted entries. The freed links will be reused by
+// subsequent additions.
+func (m *Raw[K, V]) DeleteFunc(key K, pred func(val *V) bool) (count int, err error) {
+	if m.readonly {
+		return 0, errReadOnly
+	}
+
+	m.rehashStep(key)
+	idx := m.getIndexAtIndex(m.getBucketIdx(m.getBucket(key)))
+
+	for *idx != 0 {
+		linkIdx := *idx
+		link := m.getLinkAtIndex(linkIdx)
+
+		if link.Key == key && pred(&link.Val) {
+			*idx = link.NextIdx
+			m.freeLink(linkIdx)
+			count++
+			continue
+		}
+
+		idx = &link.NextIdx
+	}
+
+	return
+}
+
+func (m *Raw[K, V]) freeLink(idx K) {
+	m.freeUnusedLink(idx)
+	m.head.length--
+}
+
+func (m *Raw[K, V]) freeUnusedLink(idx K) {
+	var val V
+
+	link := m.getLinkAtIndex(idx)
+	link.Key, link.Val, link.NextIdx = 0, val, m.head.freeIdx
+	m.head.freeIdx = idx
 }
 
 func (m *Raw[K, V]) findLeafIdx(key K) (idx *K) {
@@ -243,11 +543,11 @@ func (m *Raw[K, V]) findLeafIdx(key K) (idx *K) {
 }
 
 func (m *Raw[K, V]) getBucket(key K) K {
-	return key % m.head.buckets
+	return m.hasher.Hash(key) % m.head.buckets
 }
 
 func (m *Raw[K, V]) getBucketIdx(bucket K) (idx K) {
-	return m.head.headSize + bucket*m.head.keySize
+	return m.head.bucketsIdx + bucket*m.head.keySize
 }
 
 func (m *Raw[K, V]) getIndexAtIndex(idx K) *K {
@@ -258,6 +558,53 @@ func (m *Raw[K, V]) getLinkAtIndex(idx K) *Link[K, V] {
 	return utils.BytesToPointer[Link[K, V]](m.data[idx : idx+m.head.linkSize])
 }
 
+// Returns the index of an unused link, taking it from the list of freed links
+// if there are any. Returns 0 if the hashmap is full.
 func (m *Raw[K, V]) getAvailableIndex() (idx K) {
-	return m.head.headSize + m.head.buckets*m.head.keySize + m.head.length*m.head.linkSize
+	if idx = m.head.freeIdx; idx != 0 {
+		m.head.freeIdx = m.getLinkAtIndex(idx).NextIdx
+		return
+	}
+
+	if m.head.tailIdx+m.head.linkSize > m.head.endIdx {
+		return 0
+	}
+
+	idx = m.head.tailIdx
+	m.head.tailIdx += m.head.linkSize
+	return
+}
+
+// Extend the file with a number of bytes and map it again, and return the
+// index of the first added byte. As the file is extended before the size is
+// updated, an extension that is interrupted leaves a larger file, which is
+// truncated when opened again.
+func (m *Raw[K, V]) extend(size K) (idx K, err error) {
+	if m.readonly {
+		return 0, errReadOnly
+	}
+
+	if err = m.Flush(); err != nil {
+		return
+	}
+
+	idx = m.head.size
+	size += idx
+
+	if err = m.file.Truncate(int64(size)); err != nil {
+		return
+	}
+
+	data, err := mmap.Map(m.file, mmap.RDWR, 0)
+
+	if err != nil {
+		return
+	}
+
+	m.stale = append(m.stale, m.data)
+	m.data = data
+	m.head = utils.BytesToPointer[hashmmapHeader[K]](m.data[:m.head.headSize])
+	m.head.size = size
+
+	return
 }
@@ -3,6 +3,7 @@ package hashmmap
 import (
 	"unsafe"
 
+	"github.com/webbmaffian/go-mad/internal/preamble"
 	"github.com/webbmaffian/go-mad/internal/utils"
 )
 
@@ -12,26 +13,45 @@ func newHashmmapHeader[K utils.Unsigned, V any]() *hashmmapHeader[K] {
 	var link Link[K, V]
 
 	h := &hashmmapHeader[K]{
-		buckets: 255,
+		preamble: preamble.New(preamble.KindHashmap),
+		buckets:  255,
 	}
 	h.headSize = K(unsafe.Sizeof(*h))
 	h.keySize = K(unsafe.Sizeof(key))
 	h.valSize = K(unsafe.Sizeof(val))
 	h.linkSize = K(unsafe.Sizeof(link))
+	h.fingerprint = utils.Fingerprint(utils.TypeOf[K](), utils.TypeOf[V]())
 
 	return h
 }
 
 type hashmmapHeader[K utils.Unsigned] struct {
-	headSize K
-	keySize  K
-	valSize  K
-	linkSize K
-	capacity K
-	length   K
-	buckets  K
+	preamble      preamble.Preamble
+	headSize      K
+	keySize       K
+	valSize       K
+	linkSize      K
+	capacity      K
+	length        K
+	buckets       K
+	freeIdx       K      // First link in the list of freed links, or 0 if none.
+	bucketsIdx    K      // Start of the bucket index.
+	oldBuckets    K      // Number of buckets in the previous bucket index while rehashing, otherwise 0.
+	oldBucketsIdx K      // Start of the previous bucket index while rehashing.
+	rehashPos     K      // Next bucket in the previous bucket index to migrate.
+	migrateIdx    K      // Link being migrated while rehashing, or 0.
+	tailIdx       K      // First link that has never been used.
+	endIdx        K      // End of the region that new links are taken from.
+	size          K      // Total size of the file.
+	hasher        K      // ID of the hasher that the file was created with.
+	fingerprint   uint64 // Layout of the key and value types.
 }
 
-func (h hashmmapHeader[K]) fileSize() K {
-	return h.headSize + h.buckets*h.keySize + h.capacity*h.linkSize
+// Lay out a new file with the bucket index right after the header, followed
+// by all links.
+func (h *hashmmapHeader[K]) layout() {
+	h.bucketsIdx = h.headSize
+	h.tailIdx = h.bucketsIdx + h.buckets*h.keySize
+	h.endIdx = h.tailIdx + h.capacity*h.linkSize
+	h.size = h.endIdx
 }
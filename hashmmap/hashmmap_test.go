@@ -0,0 +1,562 @@
+package hashmmap
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type rawEntry struct {
+	key, val uint64
+}
+
+const (
+	opAdd    = 'a'
+	opPut    = 'p'
+	opDelete = 'd'
+	opDelVal = 'v' // Delete the entries with the key and value.
+)
+
+type rawOp struct {
+	op       byte
+	key, val uint64
+}
+
+func openRaw(t *testing.T, path string, capacity uint64) *Raw[uint64, uint64] {
+	t.Helper()
+
+	m, err := NewRaw[uint64, uint64](path, capacity)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func applyRaw(m *Raw[uint64, uint64], ops []rawOp) {
+	for _, o := range ops {
+		switch o.op {
+		case opAdd:
+			m.Add(o.key, o.val)
+		case opPut:
+			m.Put(o.key, o.val)
+		case opDelete:
+			m.Delete(o.key)
+		case opDelVal:
+			m.DeleteFunc(o.key, func(v *uint64) bool { return *v == o.val })
+		}
+	}
+}
+
+// Check that the hashmap holds exactly the entries, and that entries with the
+// same key are found in the same order.
+func checkRaw(t *testing.T, m *Raw[uint64, uint64], want []rawEntry) {
+	t.Helper()
+
+	if l := m.Len(); l != len(want) {
+		t.Fatalf("expected length %d, got %d", len(want), l)
+	}
+
+	vals := make(map[uint64][]uint64)
+	count := make(map[rawEntry]int)
+
+	for _, e := range want {
+		vals[e.key] = append(vals[e.key], e.val)
+		count[e]++
+	}
+
+	for key, wantVals := range vals {
+		var got []uint64
+		f := m.Find(key)
+
+		for f.Next() {
+			got = append(got, *f.Val())
+		}
+
+		if len(got) != len(wantVals) {
+			t.Fatalf("key %d: expected %v, got %v", key, wantVals, got)
+		}
+
+		for i := range got {
+			if got[i] != wantVals[i] {
+				t.Fatalf("key %d: expected %v, got %v", key, wantVals, got)
+			}
+		}
+	}
+
+	iter := m.Iterate()
+
+	for iter.Next() {
+		e := rawEntry{iter.Key(), *iter.Val()}
+
+		if count[e] == 0 {
+			t.Fatalf("unexpected entry %v", e)
+		}
+
+		count[e]--
+	}
+}
+
+func TestRaw(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []rawOp
+		want []rawEntry
+	}{
+		{"add", []rawOp{{opAdd, 1, 10}, {opAdd, 2, 20}}, []rawEntry{{1, 10}, {2, 20}}},
+		{"add same key", []rawOp{{opAdd, 1, 10}, {opAdd, 1, 11}}, []rawEntry{{1, 10}, {1, 11}}},
+		{"put", []rawOp{{opPut, 1, 10}, {opPut, 1, 11}, {opPut, 2, 20}}, []rawEntry{{1, 11}, {2, 20}}},
+		{"put replaces first", []rawOp{{opAdd, 1, 10}, {opAdd, 1, 11}, {opPut, 1, 12}}, []rawEntry{{1, 12}, {1, 11}}},
+		{"delete", []rawOp{{opAdd, 1, 10}, {opAdd, 2, 20}, {opAdd, 1, 11}, {opDelete, 1, 0}}, []rawEntry{{2, 20}}},
+		{"delete missing", []rawOp{{opAdd, 1, 10}, {opDelete, 2, 0}}, []rawEntry{{1, 10}}},
+		{"delete value", []rawOp{{opAdd, 1, 10}, {opAdd, 1, 11}, {opAdd, 1, 12}, {opDelVal, 1, 11}}, []rawEntry{{1, 10}, {1, 12}}},
+		{"same bucket", []rawOp{{opAdd, 1, 10}, {opAdd, 256, 20}, {opAdd, 511, 30}, {opDelete, 256, 0}}, []rawEntry{{1, 10}, {511, 30}}},
+		{"reuse freed links", []rawOp{{opAdd, 1, 10}, {opAdd, 2, 20}, {opDelete, 1, 0}, {opDelete, 2, 0}, {opAdd, 3, 30}, {opAdd, 4, 40}}, []rawEntry{{3, 30}, {4, 40}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "map")
+			m := openRaw(t, path, 8)
+
+			applyRaw(m, tt.ops)
+			checkRaw(t, m, tt.want)
+
+			if err := m.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			m = openRaw(t, path, 8)
+			defer m.Close()
+
+			checkRaw(t, m, tt.want)
+		})
+	}
+}
+
+func TestRawReuseFreedLinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "map")
+	m := openRaw(t, path, 4)
+	applyRaw(m, []rawOp{{opAdd, 1, 10}, {opAdd, 2, 20}, {opAdd, 3, 30}, {opAdd, 4, 40}, {opDelete, 2, 0}, {opDelete, 3, 0}})
+
+	if m.head.freeIdx == 0 {
+		t.Fatal("expected freed links")
+	}
+
+	// The list of freed links is kept in the file
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m = openRaw(t, path, 4)
+	defer m.Close()
+
+	applyRaw(m, []rawOp{{opAdd, 5, 50}, {opAdd, 6, 60}})
+
+	if m.head.freeIdx != 0 {
+		t.Fatal("expected all freed links to be reused")
+	}
+
+	checkRaw(t, m, []rawEntry{{1, 10}, {4, 40}, {5, 50}, {6, 60}})
+}
+
+// Apply operations to a list of entries, as they would be to a hashmap.
+func modelRaw(entries []rawEntry, ops []rawOp) []rawEntry {
+	entries = append([]rawEntry(nil), entries...)
+
+	for _, o := range ops {
+		switch o.op {
+		case opAdd:
+			entries = append(entries, rawEntry{o.key, o.val})
+		case opPut:
+			replaced := false
+
+			for i := range entries {
+				if entries[i].key == o.key {
+					entries[i].val, replaced = o.val, true
+					break
+				}
+			}
+
+			if !replaced {
+				entries = append(entries, rawEntry{o.key, o.val})
+			}
+		case opDelete, opDelVal:
+			kept := entries[:0]
+
+			for _, e := range entries {
+				if e.key != o.key || (o.op == opDelVal && e.val != o.val) {
+					kept = append(kept, e)
+				}
+			}
+
+			entries = kept
+		}
+	}
+
+	return entries
+}
+
+// Entries with keys 0-99, and a second entry for keys 0-9.
+func rehashEntries() (entries []rawEntry) {
+	for key := uint64(0); key < 100; key++ {
+		entries = append(entries, rawEntry{key, key})
+	}
+
+	for key := uint64(0); key < 10; key++ {
+		entries = append(entries, rawEntry{key, key + 1000})
+	}
+
+	return
+}
+
+func addEntries(t *testing.T, m *Raw[uint64, uint64], entries []rawEntry) {
+	t.Helper()
+
+	for _, e := range entries {
+		if err := m.Add(e.key, e.val); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRawRehash(t *testing.T) {
+	tests := []struct {
+		name    string
+		buckets uint64
+		steps   int // Buckets migrated before writing during the rehash.
+	}{
+		{"more buckets", 512, 0},
+		{"partly migrated", 512, 100},
+		{"fewer buckets", 7, 3},
+		{"one bucket", 1, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "map")
+			m := openRaw(t, path, 200)
+			want := rehashEntries()
+			addEntries(t, m, want)
+
+			if err := m.Rehash(tt.buckets); err != nil {
+				t.Fatal(err)
+			}
+
+			m.RehashStep(tt.steps)
+
+			if !m.Rehashing() {
+				t.Fatal("expected a rehash in progress")
+			}
+
+			checkRaw(t, m, want)
+
+			// Entries with the same key keep their order while written to
+			ops := []rawOp{{opAdd, 200, 200}, {opDelete, 5, 0}, {opPut, 6, 600}, {opAdd, 7, 700}}
+			applyRaw(m, ops)
+			want = modelRaw(want, ops)
+			checkRaw(t, m, want)
+
+			if err := m.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			m = openRaw(t, path, 200)
+			defer m.Close()
+
+			checkRaw(t, m, want)
+
+			for !m.RehashStep(rehashBatch) {
+			}
+
+			if m.Rehashing() || m.Buckets() != int(tt.buckets) {
+				t.Fatalf("expected a finished rehash to %d buckets, got %d", tt.buckets, m.Buckets())
+			}
+
+			checkRaw(t, m, want)
+		})
+	}
+}
+
+func TestRawMaxLoadFactor(t *testing.T) {
+	m := openRaw(t, filepath.Join(t.TempDir(), "map"), 600)
+	defer m.Close()
+
+	m.SetMaxLoadFactor(1)
+
+	var want []rawEntry
+
+	for key := uint64(0); key < 600; key++ {
+		want = append(want, rawEntry{key, key})
+	}
+
+	addEntries(t, m, want)
+
+	for !m.RehashStep(rehashBatch) {
+	}
+
+	if b := m.Buckets(); b < 600 {
+		t.Fatalf("expected at least 600 buckets, got %d", b)
+	}
+
+	checkRaw(t, m, want)
+}
+
+func TestRawGrow(t *testing.T) {
+	tests := []struct {
+		name    string
+		factor  float64
+		rehash  uint64 // Buckets to rehash to before growing, or 0.
+		adds    int
+		wantErr int // Number of failed additions.
+	}{
+		{"disabled", 0, 0, 6, 2},
+		{"doubled", 2, 0, 20, 0},
+		{"by one", 1.01, 0, 8, 0},
+		{"during rehash", 2, 64, 20, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "map")
+			m := openRaw(t, path, 4)
+			m.SetGrowthFactor(tt.factor)
+
+			if tt.rehash != 0 {
+				if err := m.Rehash(tt.rehash); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var want []rawEntry
+			var failed int
+
+			for key := uint64(0); key < uint64(tt.adds); key++ {
+				if err := m.Add(key, key); err != nil {
+					if !errors.Is(err, ErrFull) {
+						t.Fatal(err)
+					}
+
+					failed++
+					continue
+				}
+
+				want = append(want, rawEntry{key, key})
+			}
+
+			if failed != tt.wantErr {
+				t.Fatalf("expected %d failed additions, got %d", tt.wantErr, failed)
+			}
+
+			checkRaw(t, m, want)
+
+			if err := m.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			m = openRaw(t, path, 4)
+			defer m.Close()
+
+			checkRaw(t, m, want)
+
+			for !m.RehashStep(rehashBatch) {
+			}
+
+			checkRaw(t, m, want)
+		})
+	}
+}
+
+func TestRawReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "map")
+	m := openRaw(t, path, 8)
+	want := []rawEntry{{1, 10}, {2, 20}}
+	addEntries(t, m, want)
+
+	// Keep a rehash in progress, which can't be migrated when read-only
+	if err := m.Rehash(16); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := OpenRawRO[uint64, uint64](path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	writes := []struct {
+		name  string
+		write func() error
+	}{
+		{"add", func() error { return m.Add(3, 30) }},
+		{"put existing", func() (err error) { _, err = m.Put(1, 11); return }},
+		{"put new", func() (err error) { _, err = m.Put(3, 30); return }},
+		{"delete", func() (err error) { _, err = m.Delete(1); return }},
+		{"delete func", func() (err error) { _, err = m.DeleteFunc(1, func(*uint64) bool { return true }); return }},
+		{"grow", func() error { return m.Grow(16) }},
+		{"rehash", func() error { return m.Rehash(32) }},
+	}
+
+	for _, w := range writes {
+		if err = w.write(); err == nil {
+			t.Fatalf("%s: expected error", w.name)
+		}
+	}
+
+	if m.RehashStep(rehashBatch) || !m.Rehashing() {
+		t.Fatal("expected the rehash to stay in progress")
+	}
+
+	checkRaw(t, m, want)
+}
+
+func TestRawInterruptedMigration(t *testing.T) {
+	// Keys 0, 255 and 510 share the first of the default 255 buckets, but not
+	// after rehashing to 512 buckets
+	entries := []rawEntry{{0, 1}, {255, 2}, {0, 3}, {510, 4}}
+
+	tests := []struct {
+		name     string
+		migrated int // Links migrated before the interrupted one.
+		steps    int // Steps of the interrupted migration that were done.
+	}{
+		{"recorded", 0, 1},
+		{"added", 0, 2},
+		{"removed", 0, 3},
+		{"added after others", 2, 2},
+		{"removed after others", 2, 3},
+		{"last removed", 3, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "map")
+			m := openRaw(t, path, 8)
+			addEntries(t, m, entries)
+
+			if err := m.Rehash(512); err != nil {
+				t.Fatal(err)
+			}
+
+			head := m.getIndexAtIndex(m.getOldBucketIdx(0))
+
+			for i := 0; i < tt.migrated; i++ {
+				m.head.migrateIdx = *head
+				m.migrateLink(head)
+			}
+
+			// The steps of migrateLink, up to the crash
+			linkIdx := *head
+			link := m.getLinkAtIndex(linkIdx)
+			m.head.migrateIdx = linkIdx
+
+			if tt.steps >= 2 {
+				*m.findLeafIdx(link.Key) = linkIdx
+			}
+
+			if tt.steps >= 3 {
+				*head = link.NextIdx
+			}
+
+			if err := m.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			m = openRaw(t, path, 8)
+			defer m.Close()
+
+			checkRaw(t, m, entries)
+
+			for !m.RehashStep(rehashBatch) {
+			}
+
+			checkRaw(t, m, entries)
+		})
+	}
+}
+
+func TestRawGrowMappings(t *testing.T) {
+	m := openRaw(t, filepath.Join(t.TempDir(), "map"), 4)
+	defer m.Close()
+
+	m.SetGrowthFactor(1.01)
+
+	var want []rawEntry
+
+	for key := uint64(0); key < 10000; key++ {
+		want = append(want, rawEntry{key, key})
+	}
+
+	addEntries(t, m, want)
+
+	// Every grow keeps a mapping until the hashmap is closed
+	if n := len(m.stale); n > 100 {
+		t.Fatalf("expected at most 100 grows, got %d", n)
+	}
+
+	checkRaw(t, m, want)
+}
+
+func TestRawInterruptedGrow(t *testing.T) {
+	tests := []struct {
+		name     string
+		open     func(path string) (*Raw[uint64, uint64], error)
+		wantSize bool // Whether the file is truncated back.
+	}{
+		{"writable", func(path string) (*Raw[uint64, uint64], error) { return NewRaw[uint64, uint64](path) }, true},
+		{"read-only", OpenRawRO[uint64, uint64], false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "map")
+			m := openRaw(t, path, 4)
+			want := []rawEntry{{1, 10}, {2, 20}}
+			addEntries(t, m, want)
+			size, linkSize := int64(m.head.size), int64(m.head.linkSize)
+
+			if err := m.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The file is extended before the size is updated
+			if err := os.Truncate(path, size+4*linkSize); err != nil {
+				t.Fatal(err)
+			}
+
+			m, err := tt.open(path)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkRaw(t, m, want)
+
+			if c := m.Cap(); c != 4 {
+				t.Fatalf("expected capacity 4, got %d", c)
+			}
+
+			if err = m.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := os.Stat(path)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (info.Size() == size) != tt.wantSize {
+				t.Fatalf("expected truncated file %v, got size %d", tt.wantSize, info.Size())
+			}
+		})
+	}
+}
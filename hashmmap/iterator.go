@@ -9,18 +9,14 @@ type Iterator[K utils.Unsigned, V any] struct {
 	link    *Link[K, V]
 	bucket  K
 	nextIdx K
+	old     bool // Whether iterating the previous bucket index while rehashing.
 }
 
 func (iter *Iterator[K, V]) Next() bool {
-	// log.Println(iter.bucket)
-	if iter.nextIdx == 0 {
-		if iter.bucket < iter.raw.head.buckets-1 {
-			iter.bucket++
-			iter.nextIdx = *iter.raw.getIndexAtIndex(iter.raw.getBucketIdx(iter.bucket))
-			return iter.Next()
+	for iter.nextIdx == 0 {
+		if !iter.nextBucket() {
+			return false
 		}
-
-		return false
 	}
 
 	iter.link = iter.raw.getLinkAtIndex(iter.nextIdx)
@@ -29,6 +25,34 @@ func (iter *Iterator[K, V]) Next() bool {
 	return true
 }
 
+func (iter *Iterator[K, V]) nextBucket() bool {
+	head := iter.raw.head
+
+	if !iter.old {
+		if iter.bucket < head.buckets-1 {
+			iter.bucket++
+			iter.nextIdx = *iter.raw.getIndexAtIndex(iter.raw.getBucketIdx(iter.bucket))
+			return true
+		}
+
+		if head.oldBuckets == 0 {
+			return false
+		}
+
+		iter.old, iter.bucket = true, 0
+		iter.nextIdx = *iter.raw.getIndexAtIndex(iter.raw.getOldBucketIdx(0))
+		return true
+	}
+
+	if iter.bucket < head.oldBuckets-1 {
+		iter.bucket++
+		iter.nextIdx = *iter.raw.getIndexAtIndex(iter.raw.getOldBucketIdx(iter.bucket))
+		return true
+	}
+
+	return false
+}
+
 func (iter *Iterator[K, V]) Key() K {
 	return iter.link.Key
 }
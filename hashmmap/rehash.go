@@ -0,0 +1,159 @@
+package hashmmap
+
+import "errors"
+
+// Number of buckets migrated on each write while rehashing.
+const rehashBatch = 16
+
+// Rehash automatically to twice the number of buckets when the number of
+// entries per bucket exceeds the factor. A factor of 0 disables automatic
+// rehashing, which is the default.
+func (m *Raw[K, V]) SetMaxLoadFactor(factor float64) {
+	m.maxLoad = factor
+}
+
+// Start rehashing all entries into a new bucket index with the provided number
+// of buckets. The new bucket index is appended to the file, and entries are
+// migrated incrementally on each following write. Call RehashStep to speed it
+// up. Any ongoing rehash is finished first.
+func (m *Raw[K, V]) Rehash(buckets K) (err error) {
+	if buckets == 0 {
+		return errors.New("there must be at least 1 bucket")
+	}
+
+	if m.readonly {
+		return errReadOnly
+	}
+
+	for !m.RehashStep(rehashBatch) {
+	}
+
+	idx, err := m.extend(buckets * m.head.keySize)
+
+	if err != nil {
+		return
+	}
+
+	m.head.oldBuckets, m.head.oldBucketsIdx, m.head.rehashPos = m.head.buckets, m.head.bucketsIdx, 0
+	m.head.buckets, m.head.bucketsIdx = buckets, idx
+
+	return
+}
+
+// Migrate up to a number of buckets from the previous bucket index, and return
+// whether the rehash is complete. A read-only hashmap is never migrated.
+func (m *Raw[K, V]) RehashStep(buckets int) (done bool) {
+	if m.head.oldBuckets == 0 {
+		return true
+	}
+
+	if m.readonly {
+		return false
+	}
+
+	for ; buckets > 0 && m.head.rehashPos < m.head.oldBuckets; buckets-- {
+		m.migrateBucket(m.head.rehashPos)
+		m.head.rehashPos++
+	}
+
+	if m.head.rehashPos < m.head.oldBuckets {
+		return false
+	}
+
+	m.finishRehash()
+	return true
+}
+
+// Whether a rehash is in progress.
+func (m *Raw[K, V]) Rehashing() bool {
+	return m.head.oldBuckets != 0
+}
+
+func (m *Raw[K, V]) Buckets() int {
+	return int(m.head.buckets)
+}
+
+// Migrate the bucket of the key before it's written to, so that entries with
+// the same key keep their order, and then continue with the next batch.
+func (m *Raw[K, V]) rehashStep(key K) {
+	if m.head.oldBuckets != 0 {
+		m.migrateBucket(m.getOldBucket(key))
+		m.RehashStep(rehashBatch)
+	}
+}
+
+func (m *Raw[K, V]) overloaded() bool {
+	return m.maxLoad > 0 && m.head.oldBuckets == 0 && float64(m.head.length) > float64(m.head.buckets)*m.maxLoad
+}
+
+func (m *Raw[K, V]) migrateBucket(bucket K) {
+	head := m.getIndexAtIndex(m.getOldBucketIdx(bucket))
+
+	for *head != 0 {
+		m.head.migrateIdx = *head
+		m.migrateLink(head)
+	}
+}
+
+// Move the first link of a chain in the previous bucket index to the end of
+// its chain in the new one. The link is added to the new chain before it's
+// removed from the previous one, so that an interrupted migration never loses
+// an entry. Until then, the link refers to the rest of the previous chain,
+// which is why the link being migrated is recorded in the header.
+func (m *Raw[K, V]) migrateLink(head *K) {
+	linkIdx := *head
+	link := m.getLinkAtIndex(linkIdx)
+	idx := m.getIndexAtIndex(m.getBucketIdx(m.getBucket(link.Key)))
+
+	// The link might already be added by an interrupted migration
+	for *idx != 0 && *idx != linkIdx {
+		idx = m.getIndexAtIndex(*idx)
+	}
+
+	*idx = linkIdx
+	*head = link.NextIdx
+	link.NextIdx = 0
+	m.head.migrateIdx = 0
+}
+
+// Finish a migration that was interrupted. The rest of the bucket is migrated
+// too, as entries with the same key are found in the previous chain first.
+func (m *Raw[K, V]) resumeMigration() {
+	if m.head.migrateIdx == 0 {
+		return
+	}
+
+	link := m.getLinkAtIndex(m.head.migrateIdx)
+	bucket := m.getOldBucket(link.Key)
+	head := m.getIndexAtIndex(m.getOldBucketIdx(bucket))
+
+	if *head == m.head.migrateIdx {
+		m.migrateLink(head)
+	} else {
+		// The link was already removed from the previous chain
+		link.NextIdx = 0
+		m.head.migrateIdx = 0
+	}
+
+	m.migrateBucket(bucket)
+}
+
+// Reuse the space of the previous bucket index for links.
+func (m *Raw[K, V]) finishRehash() {
+	end := m.head.oldBucketsIdx + m.head.oldBuckets*m.head.keySize
+
+	for idx := m.head.oldBucketsIdx; idx+m.head.linkSize <= end; idx += m.head.linkSize {
+		m.freeUnusedLink(idx)
+		m.head.capacity++
+	}
+
+	m.head.oldBuckets, m.head.oldBucketsIdx, m.head.rehashPos = 0, 0, 0
+}
+
+func (m *Raw[K, V]) getOldBucket(key K) K {
+	return m.hasher.Hash(key) % m.head.oldBuckets
+}
+
+func (m *Raw[K, V]) getOldBucketIdx(bucket K) (idx K) {
+	return m.head.oldBucketsIdx + bucket*m.head.keySize
+}
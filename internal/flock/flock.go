@@ -0,0 +1,41 @@
+package flock
+
+import (
+	"os"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+type lockError string
+
+var _ error = lockError("")
+
+func (err lockError) Error() string {
+	return string(err)
+}
+
+const ErrLocked = lockError("file is locked by another process")
+
+// Take an advisory lock on a file without blocking - exclusive for writers and
+// shared for readers. If another process holds a conflicting lock, ErrLocked is
+// returned. The lock is released when the file is closed.
+func Lock(f *os.File, exclusive bool) error {
+	return lock(f, exclusive)
+}
+
+// Unmap the data and close the file (and thereby release its lock) if an error
+// has occurred. Meant to be deferred right after the file is opened. The lock
+// is held for as long as the file is mapped, so the data must be unmapped too.
+func CloseOnError(err *error, f **os.File, data *mmap.MMap) {
+	if *err == nil {
+		return
+	}
+
+	if data != nil && *data != nil {
+		data.Unmap()
+	}
+
+	if *f != nil {
+		(*f).Close()
+	}
+}
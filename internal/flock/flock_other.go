@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package flock
+
+import "os"
+
+// Advisory locks aren't supported on this platform.
+func lock(f *os.File, exclusive bool) error {
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package flock
+
+import (
+	"os"
+	"syscall"
+)
+
+func lock(f *os.File, exclusive bool) (err error) {
+	how := syscall.LOCK_SH
+
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	for {
+		if err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != syscall.EINTR {
+			break
+		}
+	}
+
+	if err == syscall.EWOULDBLOCK {
+		return ErrLocked
+	}
+
+	return
+}
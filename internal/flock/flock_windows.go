@@ -0,0 +1,25 @@
+//go:build windows
+
+package flock
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+func lock(f *os.File, exclusive bool) (err error) {
+	flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+
+	if exclusive {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+
+	err = windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, new(windows.Overlapped))
+
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return ErrLocked
+	}
+
+	return
+}
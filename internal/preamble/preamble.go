@@ -0,0 +1,135 @@
+package preamble
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/webbmaffian/go-mad/internal/utils"
+)
+
+// Current version of the file format. Bump on any incompatible change.
+const Version = 1
+
+var magic = [4]byte{'G', 'M', 'A', 'D'}
+
+type Kind uint8
+
+const (
+	KindArray Kind = iota + 1
+	KindHashmap
+	KindChannel
+	KindMatrix
+	KindArena
+	KindSPSCChannel
+	KindVarChannel
+	KindGroupChannel
+	KindLogSegment
+	KindDelayHeap
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindArray:
+		return "array"
+	case KindHashmap:
+		return "hashmap"
+	case KindChannel:
+		return "channel"
+	case KindMatrix:
+		return "matrix"
+	case KindArena:
+		return "arena"
+	case KindSPSCChannel:
+		return "SPSC channel"
+	case KindVarChannel:
+		return "variable-length channel"
+	case KindGroupChannel:
+		return "consumer group channel"
+	case KindLogSegment:
+		return "log segment"
+	case KindDelayHeap:
+		return "delay heap"
+	}
+
+	return fmt.Sprintf("unknown (%d)", uint8(k))
+}
+
+// Current version of the layout of each kind of file, that is checked in
+// addition to the version of the file format. Every kind starts at layout 1.
+// Bump the layout of a kind on any incompatible change of its header or data.
+func (k Kind) layout() uint16 {
+	return 1
+}
+
+const (
+	littleEndian uint8 = iota + 1
+	bigEndian
+)
+
+// Common start of every file, identifying the data structure it contains and
+// the architecture it was written on. It must be the first field of every
+// file header.
+type Preamble struct {
+	magic    [4]byte
+	version  uint16
+	kind     Kind
+	endian   uint8
+	wordSize uint8
+	_        uint8
+	layout   uint16
+	_        [4]byte
+}
+
+func New(kind Kind) Preamble {
+	return Preamble{
+		magic:    magic,
+		version:  Version,
+		kind:     kind,
+		endian:   nativeEndian(),
+		wordSize: uint8(unsafe.Sizeof(int(0))),
+		layout:   kind.layout(),
+	}
+}
+
+func (p *Preamble) Kind() Kind {
+	return p.kind
+}
+
+// Ensure that a preamble read from a file matches the expected one.
+func (p *Preamble) Validate(expected *Preamble) error {
+	if p.magic != magic {
+		return errors.New("not a go-mad file")
+	}
+
+	if p.version != expected.version {
+		return fmt.Errorf("unsupported format version %d (expected %d)", p.version, expected.version)
+	}
+
+	if p.kind != expected.kind {
+		return fmt.Errorf("invalid kind of file: %s (expected %s)", p.kind, expected.kind)
+	}
+
+	if p.layout != expected.layout {
+		return fmt.Errorf("unsupported layout version %d of %s (expected %d)", p.layout, p.kind, expected.layout)
+	}
+
+	if p.endian != expected.endian {
+		return errors.New("file was written on an architecture with another endianness")
+	}
+
+	if p.wordSize != expected.wordSize {
+		return fmt.Errorf("file was written on a %d-bit architecture", int(p.wordSize)*8)
+	}
+
+	return nil
+}
+
+func nativeEndian() uint8 {
+	if utils.Endian == binary.BigEndian {
+		return bigEndian
+	}
+
+	return littleEndian
+}
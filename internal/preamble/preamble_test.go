@@ -0,0 +1,39 @@
+package preamble
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(p *Preamble)
+		ok     bool
+	}{
+		{"same", func(p *Preamble) {}, true},
+		{"magic", func(p *Preamble) { p.magic[0] = 'X' }, false},
+		{"version", func(p *Preamble) { p.version++ }, false},
+		{"kind", func(p *Preamble) { p.kind = KindArray }, false},
+		{"old layout", func(p *Preamble) { p.layout = 0 }, false},
+		{"endian", func(p *Preamble) { p.endian ^= littleEndian | bigEndian }, false},
+		{"word size", func(p *Preamble) { p.wordSize /= 2 }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected := New(KindChannel)
+			p := expected
+			tt.modify(&p)
+
+			if err := p.Validate(&expected); (err == nil) != tt.ok {
+				t.Fatalf("expected ok %v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestLayout(t *testing.T) {
+	for k := KindArray; k <= KindDelayHeap; k++ {
+		if l := New(k).layout; l != 1 {
+			t.Fatalf("expected layout 1 of %s, got %d", k, l)
+		}
+	}
+}
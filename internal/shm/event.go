@@ -0,0 +1,38 @@
+package shm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Event in shared memory, that processes mapping the same file can wait for.
+// Each notification increases a sequence number, so that a notification
+// between reading the sequence number and starting to wait is never missed.
+type Event struct {
+	seq     uint32
+	waiters uint32
+}
+
+// Current sequence number, to be read while still holding the lock that
+// protects the awaited condition.
+func (e *Event) Seq() uint32 {
+	return atomic.LoadUint32(&e.seq)
+}
+
+// Wait until notified after the sequence number was read, or until the timeout.
+func (e *Event) Wait(seq uint32, timeout time.Duration) {
+	atomic.AddUint32(&e.waiters, 1)
+	defer atomic.AddUint32(&e.waiters, ^uint32(0))
+
+	if atomic.LoadUint32(&e.seq) == seq {
+		wait(&e.seq, seq, timeout)
+	}
+}
+
+func (e *Event) Notify() {
+	atomic.AddUint32(&e.seq, 1)
+
+	if atomic.LoadUint32(&e.waiters) > 0 {
+		wake(&e.seq)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build linux
+
+package shm
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	futexWait = 0
+	futexWake = 1
+)
+
+// Sleep as long as the word at addr equals val, or until the timeout. The
+// futex is not private, as it's shared between processes.
+func wait(addr *uint32, val uint32, timeout time.Duration) {
+	ts := syscall.NsecToTimespec(int64(timeout))
+	syscall.Syscall6(syscall.SYS_FUTEX, uintptr(unsafe.Pointer(addr)), futexWait, uintptr(val), uintptr(unsafe.Pointer(&ts)), 0, 0)
+}
+
+// Wake all processes sleeping on the word at addr.
+func wake(addr *uint32) {
+	syscall.Syscall6(syscall.SYS_FUTEX, uintptr(unsafe.Pointer(addr)), futexWake, uintptr(^uint32(0)>>1), 0, 0, 0)
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+
+package shm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Interval at which waiters poll for changes where futexes aren't available.
+const pollInterval = time.Millisecond
+
+// Sleep as long as the word at addr equals val, or until the timeout.
+func wait(addr *uint32, val uint32, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	for atomic.LoadUint32(addr) == val && time.Now().Before(deadline) {
+		time.Sleep(pollInterval)
+	}
+}
+
+// Waiters poll, so there is no one to wake.
+func wake(addr *uint32) {}
@@ -0,0 +1,120 @@
+package shm
+
+import (
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Number of attempts to take a mutex by spinning before sleeping.
+const spins = 64
+
+// Interval at which a sleeping waiter checks whether the holder of a mutex is
+// still alive.
+const ownerCheckInterval = 100 * time.Millisecond
+
+// Mutex in shared memory, that can be used across processes mapping the same
+// file. It's held by a process rather than a goroutine, so it must be combined
+// with a sync.Mutex within each process. If the holding process dies, the
+// mutex is taken over by the next process that tries to lock it.
+//
+// The holder is identified by its process ID together with its start time
+// where available (currently Linux), so that a new process reusing the ID
+// isn't mistaken for the holder. As process IDs are only meaningful within a
+// PID namespace, all processes must share the same one - e.g. containers must
+// share the PID namespace of the host or of each other.
+type Mutex struct {
+	owner   uint64 // Process ID and start time of the holder, or 0 if unlocked.
+	waiters uint32
+}
+
+var (
+	selfOnce sync.Once
+	self     uint64
+)
+
+// The owner of mutexes held by this process.
+func selfOwner() uint64 {
+	selfOnce.Do(func() {
+		pid := os.Getpid()
+		self = newOwner(uint32(pid), processStart(pid))
+	})
+
+	return self
+}
+
+// The process ID comes first in memory, regardless of the byte order, so that
+// it can be waited for as a 32-bit word.
+func newOwner(pid uint32, start uint32) uint64 {
+	o := [2]uint32{pid, start}
+	return *(*uint64)(unsafe.Pointer(&o))
+}
+
+func splitOwner(owner uint64) (pid uint32, start uint32) {
+	o := *(*[2]uint32)(unsafe.Pointer(&owner))
+	return o[0], o[1]
+}
+
+// Whether the process holding a mutex is still alive. A start time of 0 means
+// that it's unknown.
+func ownerAlive(owner uint64) bool {
+	pid, start := splitOwner(owner)
+
+	if !processAlive(int(pid)) {
+		return false
+	}
+
+	if start == 0 {
+		return true
+	}
+
+	s := processStart(int(pid))
+	return s == 0 || s == start
+}
+
+func (m *Mutex) pidWord() *uint32 {
+	return (*uint32)(unsafe.Pointer(&m.owner))
+}
+
+// Lock the mutex, and return whether it was taken over from a holder that has
+// died. In that case, the state that the mutex protects might be inconsistent.
+func (m *Mutex) Lock() (tookOver bool) {
+	self := selfOwner()
+
+	for i := 0; ; i++ {
+		if atomic.CompareAndSwapUint64(&m.owner, 0, self) {
+			return
+		}
+
+		owner := atomic.LoadUint64(&m.owner)
+
+		if owner == 0 {
+			continue
+		}
+
+		if !ownerAlive(owner) && atomic.CompareAndSwapUint64(&m.owner, owner, self) {
+			return true
+		}
+
+		if i < spins {
+			runtime.Gosched()
+			continue
+		}
+
+		pid, _ := splitOwner(owner)
+		atomic.AddUint32(&m.waiters, 1)
+		wait(m.pidWord(), pid, ownerCheckInterval)
+		atomic.AddUint32(&m.waiters, ^uint32(0))
+	}
+}
+
+func (m *Mutex) Unlock() {
+	atomic.StoreUint64(&m.owner, 0)
+
+	if atomic.LoadUint32(&m.waiters) > 0 {
+		wake(m.pidWord())
+	}
+}
@@ -0,0 +1,54 @@
+package shm
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestOwnerAlive(t *testing.T) {
+	pid := uint32(os.Getpid())
+	_, start := splitOwner(selfOwner())
+
+	tests := []struct {
+		name  string
+		owner uint64
+		alive bool
+	}{
+		{"self", selfOwner(), true},
+		{"unknown start", newOwner(pid, 0), true},
+		{"reused process ID", newOwner(pid, start+2), runtime.GOOS != "linux"},
+		{"no such process", newOwner(1<<22+1, 0), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if alive := ownerAlive(tt.owner); alive != tt.alive {
+				t.Fatalf("expected %v, got %v", tt.alive, alive)
+			}
+		})
+	}
+}
+
+func TestMutexTakeOver(t *testing.T) {
+	var m Mutex
+
+	// Held by a process that has died
+	m.owner = newOwner(1<<22+1, 0)
+
+	if !m.Lock() || m.owner != selfOwner() {
+		t.Fatal("expected the mutex to be taken over")
+	}
+
+	m.Unlock()
+
+	if m.Lock() {
+		t.Fatal("expected an unlocked mutex not to be taken over")
+	}
+
+	m.Unlock()
+
+	if m.owner != 0 {
+		t.Fatal("expected the mutex to be unlocked")
+	}
+}
@@ -0,0 +1,40 @@
+//go:build linux
+
+package shm
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+)
+
+// Start time of a process in clock ticks since boot, truncated to 32 bits, or
+// 0 if unknown.
+func processStart(pid int) uint32 {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+
+	if err != nil {
+		return 0
+	}
+
+	// The command name is within parentheses, and might contain anything
+	if i := bytes.LastIndexByte(b, ')'); i >= 0 {
+		b = b[i+1:]
+	}
+
+	// The start time is the 22nd field, and the 20th after the command name
+	fields := bytes.Fields(b)
+
+	if len(fields) < 20 {
+		return 0
+	}
+
+	start, err := strconv.ParseUint(string(fields[19]), 10, 64)
+
+	if err != nil {
+		return 0
+	}
+
+	// A start time of 0 would mean unknown
+	return uint32(start) | 1
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package shm
+
+// Without a portable way to get the start time of a process, it's unknown.
+func processStart(pid int) uint32 {
+	return 0
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package shm
+
+import "syscall"
+
+// Whether a process with the ID exists in the PID namespace of this process.
+// The ID might have been reused by another process, which is told apart by its
+// start time.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"reflect"
+)
+
+func TypeOf[T any]() reflect.Type {
+	var v T
+	return reflect.TypeOf(&v).Elem()
+}
+
+// Compute a fingerprint of the memory layout of types, based on the names,
+// kinds, sizes and offsets of all fields. Two types with the same fingerprint
+// can safely be read from the same file.
+func Fingerprint(types ...reflect.Type) uint64 {
+	h := fnv.New64a()
+
+	for _, t := range types {
+		writeLayout(h, t)
+	}
+
+	return h.Sum64()
+}
+
+func writeLayout(h hash.Hash64, t reflect.Type) {
+	fmt.Fprintf(h, "%d:%d", t.Kind(), t.Size())
+
+	switch t.Kind() {
+
+	case reflect.Struct:
+		h.Write([]byte{'{'})
+
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			fmt.Fprintf(h, "%s@%d=", f.Name, f.Offset)
+			writeLayout(h, f.Type)
+			h.Write([]byte{';'})
+		}
+
+		h.Write([]byte{'}'})
+
+	case reflect.Array:
+		fmt.Fprintf(h, "[%d]", t.Len())
+		writeLayout(h, t.Elem())
+	}
+}
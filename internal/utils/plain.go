@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+)
+
+var referenceKinds = map[reflect.Kind]string{
+	reflect.Pointer:       "a pointer",
+	reflect.UnsafePointer: "an unsafe pointer",
+	reflect.Slice:         "a slice",
+	reflect.Map:           "a map",
+	reflect.String:        "a string",
+	reflect.Interface:     "an interface",
+	reflect.Chan:          "a channel",
+	reflect.Func:          "a function",
+}
+
+// Ensure that a type can be stored in a memory-mapped file, i.e. that it
+// doesn't contain anything referring to memory (pointers, slices, maps,
+// strings, interfaces, channels and functions).
+func ValidatePlain[T any]() error {
+	t := TypeOf[T]()
+
+	if path, ref, ok := findReference(t, ""); ok {
+		if path == "" {
+			return fmt.Errorf("type %s can't be stored in a memory-mapped file, as it's %s", t, referenceKinds[ref.Kind()])
+		}
+
+		return fmt.Errorf("type %s can't be stored in a memory-mapped file, as field %s is %s (%s)", t, path, referenceKinds[ref.Kind()], ref)
+	}
+
+	return nil
+}
+
+// Find the first type referring to memory, and its field path.
+func findReference(t reflect.Type, path string) (string, reflect.Type, bool) {
+	if _, ok := referenceKinds[t.Kind()]; ok {
+		return path, t, true
+	}
+
+	switch t.Kind() {
+
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			fieldPath := f.Name
+
+			if path != "" {
+				fieldPath = path + "." + f.Name
+			}
+
+			if p, ref, ok := findReference(f.Type, fieldPath); ok {
+				return p, ref, ok
+			}
+		}
+
+	case reflect.Array:
+		return findReference(t.Elem(), path+"[]")
+	}
+
+	return "", nil, false
+}
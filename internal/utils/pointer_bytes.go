@@ -18,3 +18,13 @@ func BytesToPointer[T any](b []byte) *T {
 	header := *(*sliceHeader)(unsafe.Pointer(&b))
 	return (*T)(header.Data)
 }
+
+func BytesToSlice[T any](b []byte, length int) []T {
+	header := sliceHeader{
+		Data: (*sliceHeader)(unsafe.Pointer(&b)).Data,
+		Len:  length,
+		Cap:  length,
+	}
+
+	return *(*[]T)(unsafe.Pointer(&header))
+}
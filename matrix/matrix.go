@@ -4,6 +4,7 @@ import (
 	"errors"
 	"unsafe"
 
+	"github.com/webbmaffian/go-mad/internal/preamble"
 	"github.com/webbmaffian/go-mad/matrix/internal/gonum"
 	"github.com/webbmaffian/go-mad/mmarr"
 )
@@ -65,6 +66,10 @@ type matrixHead struct {
 	cols int
 }
 
+func (matrixHead) FileKind() preamble.Kind {
+	return preamble.KindMatrix
+}
+
 // Dims returns the dimensions (rows + columns) of a Matrix.
 func (m *Matrix[T]) Dims() (r, c int) {
 	return m.head.rows, m.head.cols
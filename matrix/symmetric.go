@@ -3,6 +3,7 @@ package matrix
 import (
 	"unsafe"
 
+	"github.com/webbmaffian/go-mad/internal/preamble"
 	"github.com/webbmaffian/go-mad/matrix/internal/gonum"
 	"github.com/webbmaffian/go-mad/mmarr"
 )
@@ -13,7 +14,7 @@ var (
 )
 
 func NewSym[T any](filepath string, size int) (m *SymMatrix[T], err error) {
-	arr, err := mmarr.New[T](filepath, handshakes(size))
+	arr, err := mmarr.NewWithHeader[T, symMatrixHead](filepath, handshakes(size))
 
 	if err != nil {
 		return
@@ -28,7 +29,7 @@ func NewSym[T any](filepath string, size int) (m *SymMatrix[T], err error) {
 }
 
 func OpenSymRO[T any](filepath string) (m *SymMatrix[T], err error) {
-	arr, err := mmarr.OpenRO[T](filepath)
+	arr, err := mmarr.OpenROWithHeader[T, symMatrixHead](filepath)
 
 	if err != nil {
 		return
@@ -43,10 +44,16 @@ func OpenSymRO[T any](filepath string) (m *SymMatrix[T], err error) {
 }
 
 type SymMatrix[T any] struct {
-	arr  *mmarr.Array[T, struct{}]
+	arr  *mmarr.Array[T, symMatrixHead]
 	size int
 }
 
+type symMatrixHead struct{}
+
+func (symMatrixHead) FileKind() preamble.Kind {
+	return preamble.KindMatrix
+}
+
 // Dims returns the dimensions (rows + columns) of a Matrix.
 func (m *SymMatrix[T]) Dims() (r, c int) {
 	return m.size, m.size
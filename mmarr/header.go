@@ -2,14 +2,30 @@ package mmarr
 
 import (
 	"unsafe"
+
+	"github.com/webbmaffian/go-mad/internal/preamble"
+	"github.com/webbmaffian/go-mad/internal/utils"
 )
 
+// A custom header can implement this interface to tell what kind of data
+// structure that the array is used for, e.g. a matrix.
+type kinded interface {
+	FileKind() preamble.Kind
+}
+
 func newHeader[T any, H any](lenCap ...int) *header[H] {
 	var item T
 
 	h := new(header[H])
+	h.preamble = preamble.New(preamble.KindArray)
+
+	if k, ok := any(h.custom).(kinded); ok {
+		h.preamble = preamble.New(k.FileKind())
+	}
+
 	h.headSize = int(unsafe.Sizeof(*h))
 	h.itemSize = int(unsafe.Sizeof(item))
+	h.fingerprint = utils.Fingerprint(utils.TypeOf[T](), utils.TypeOf[H]())
 
 	if lenCap != nil {
 		h.length = lenCap[0]
@@ -33,11 +49,13 @@ func newHeader[T any, H any](lenCap ...int) *header[H] {
 }
 
 type header[H any] struct {
-	custom   H
-	headSize int
-	itemSize int
-	length   int
-	capacity int
+	preamble    preamble.Preamble
+	custom      H
+	headSize    int
+	itemSize    int
+	length      int
+	capacity    int
+	fingerprint uint64 // Layout of the item and custom header types.
 }
 
 func (h header[H]) fileSize() int {
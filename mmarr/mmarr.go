@@ -6,19 +6,37 @@ import (
 	"os"
 
 	"github.com/edsrzf/mmap-go"
+	"github.com/webbmaffian/go-mad/internal/flock"
 	"github.com/webbmaffian/go-mad/internal/utils"
 )
 
+// Files are locked while open - exclusively when opened for writing, otherwise
+// shared. Opening a file that is locked by another process fails with
+// ErrLocked.
+const ErrLocked = flock.ErrLocked
+
+var ErrFull = errors.New("array is full")
+
+// Smallest growth factor used when growing automatically. Every grow keeps the
+// previous mapping until the array is closed, so the number of mappings must
+// grow logarithmically with the capacity.
+const minGrowth = 1.125
+
 // Initialize a new memory-mapped array with a filepath, length and capacity.
 // If file doesn't exist, capacity is mandatory. If left out, capacity will
 // equal to the length. If capacity and/or length is provided, and the file
 // already exists, they must match the values from the file.
-// The provided type (`T`) MUST NOT contain any pointer nor slice.
+// The provided type (`T`) MUST NOT contain any pointer nor slice, which is
+// validated on open.
 func New[T any](filepath string, lenCap ...int) (arr *Array[T, struct{}], err error) {
 	return NewWithHeader[T, struct{}](filepath, lenCap...)
 }
 
 func NewWithHeader[T any, H any](filepath string, lenCap ...int) (arr *Array[T, H], err error) {
+	if err = validateTypes[T, H](); err != nil {
+		return nil, err
+	}
+
 	arr = &Array[T, H]{
 		head: newHeader[T, H](lenCap...),
 	}
@@ -27,6 +45,8 @@ func NewWithHeader[T any, H any](filepath string, lenCap ...int) (arr *Array[T,
 		return nil, errors.New("item must be at least 1 byte")
 	}
 
+	defer flock.CloseOnError(&err, &arr.file, &arr.data)
+
 	var created bool
 	info, err := os.Stat(filepath)
 
@@ -35,9 +55,17 @@ func NewWithHeader[T any, H any](filepath string, lenCap ...int) (arr *Array[T,
 			return
 		}
 
+		if err = flock.Lock(arr.file, true); err != nil {
+			return
+		}
+
 		if err = arr.validateHead(info.Size()); err != nil {
 			return
 		}
+
+		if err = arr.trim(info.Size()); err != nil {
+			return
+		}
 	} else if os.IsNotExist(err) {
 		if arr.head.capacity == 0 {
 			return nil, errors.New("capacity is mandatory")
@@ -47,6 +75,10 @@ func NewWithHeader[T any, H any](filepath string, lenCap ...int) (arr *Array[T,
 			return
 		}
 
+		if err = flock.Lock(arr.file, true); err != nil {
+			return
+		}
+
 		if err = arr.file.Truncate(int64(arr.head.fileSize())); err != nil {
 			return
 		}
@@ -80,6 +112,10 @@ func OpenRO[T any](filepath string) (arr *Array[T, struct{}], err error) {
 }
 
 func OpenROWithHeader[T any, H any](filepath string) (arr *Array[T, H], err error) {
+	if err = validateTypes[T, H](); err != nil {
+		return nil, err
+	}
+
 	arr = &Array[T, H]{
 		head: newHeader[T, H](),
 	}
@@ -88,6 +124,8 @@ func OpenROWithHeader[T any, H any](filepath string) (arr *Array[T, H], err erro
 		return nil, errors.New("item must be at least 1 byte")
 	}
 
+	defer flock.CloseOnError(&err, &arr.file, &arr.data)
+
 	info, err := os.Stat(filepath)
 
 	if err != nil {
@@ -98,6 +136,10 @@ func OpenROWithHeader[T any, H any](filepath string) (arr *Array[T, H], err erro
 		return
 	}
 
+	if err = flock.Lock(arr.file, false); err != nil {
+		return
+	}
+
 	if err = arr.validateHead(info.Size()); err != nil {
 		return
 	}
@@ -107,15 +149,69 @@ func OpenROWithHeader[T any, H any](filepath string) (arr *Array[T, H], err erro
 	}
 
 	arr.head = utils.BytesToPointer[header[H]](arr.data[:arr.head.headSize])
+	arr.readonly = true
 
 	return
 }
 
+// Accept the current layout of the item type (`T`) for an existing file, after
+// an intentional change of the type that keeps its size. Any data that doesn't
+// match the new layout will be garbage.
+func ResetFingerprint[T any](filepath string) error {
+	return ResetFingerprintWithHeader[T, struct{}](filepath)
+}
+
+func ResetFingerprintWithHeader[T any, H any](filepath string) (err error) {
+	expected := newHeader[T, H]()
+	f, err := os.OpenFile(filepath, os.O_RDWR, 0)
+
+	if err != nil {
+		return
+	}
+
+	defer f.Close()
+
+	if err = flock.Lock(f, true); err != nil {
+		return
+	}
+
+	b := make([]byte, expected.headSize)
+
+	if _, err = f.ReadAt(b, 0); err != nil {
+		return
+	}
+
+	head := utils.BytesToPointer[header[H]](b)
+
+	if err = head.preamble.Validate(&expected.preamble); err != nil {
+		return
+	}
+
+	if head.headSize != expected.headSize || head.itemSize != expected.itemSize {
+		return errors.New("invalid item size")
+	}
+
+	head.fingerprint = expected.fingerprint
+	_, err = f.WriteAt(b, 0)
+	return
+}
+
+func validateTypes[T any, H any]() (err error) {
+	if err = utils.ValidatePlain[T](); err != nil {
+		return
+	}
+
+	return utils.ValidatePlain[H]()
+}
+
 // Memory-mapped array
 type Array[T any, H any] struct {
-	data mmap.MMap
-	file *os.File
-	head *header[H]
+	data     mmap.MMap
+	file     *os.File
+	head     *header[H]
+	stale    []mmap.MMap // Previous mappings, kept alive until the array is closed.
+	growth   float64
+	readonly bool
 }
 
 func (m *Array[T, H]) validateHead(fileSize int64) (err error) {
@@ -139,22 +235,48 @@ func (m *Array[T, H]) validateHead(fileSize int64) (err error) {
 
 	head := utils.BytesToPointer[header[H]](b)
 
+	if err = head.preamble.Validate(&m.head.preamble); err != nil {
+		return
+	}
+
 	if head.itemSize != m.head.itemSize {
 		return errors.New("invalid item size")
 	}
 
+	if head.fingerprint != m.head.fingerprint {
+		return errors.New("invalid fingerprint - the layout of the type has changed")
+	}
+
 	// A capacity can never me less than the length
 	if head.capacity < head.length {
 		return errors.New("invalid capacity")
 	}
 
-	if fileSize != int64(head.fileSize()) {
+	// A larger file is left by a grow that was interrupted before the capacity
+	// was updated
+	if fileSize < int64(head.fileSize()) {
 		return errors.New("invalid file size")
 	}
 
 	return
 }
 
+// Truncate the file to the size of the capacity, after a grow that was
+// interrupted before the capacity was updated.
+func (arr *Array[T, H]) trim(fileSize int64) (err error) {
+	b := make([]byte, arr.head.headSize)
+
+	if _, err = arr.file.ReadAt(b, 0); err != nil {
+		return
+	}
+
+	if size := int64(utils.BytesToPointer[header[H]](b).fileSize()); fileSize > size {
+		err = arr.file.Truncate(size)
+	}
+
+	return
+}
+
 func (arr *Array[T, H]) Flush() error {
 	return arr.data.Flush()
 }
@@ -164,17 +286,111 @@ func (arr *Array[T, H]) Close() (err error) {
 		return
 	}
 
+	// The mapping must be released for the lock of the file to be released
+	if err = arr.data.Unmap(); err != nil {
+		return
+	}
+
+	for _, data := range arr.stale {
+		if err = data.Unmap(); err != nil {
+			return
+		}
+	}
+
+	arr.stale = nil
+
 	return arr.file.Close()
 }
 
+// Let the array grow automatically when appending to a full array. The new
+// capacity will be the current capacity multiplied by the factor (but always
+// at least one more). Factors below 1.125 grow by 1.125, as every grow keeps a
+// mapping until the array is closed. A factor of 1 or less disables growth,
+// which is the default.
+func (arr *Array[T, H]) SetGrowthFactor(factor float64) {
+	arr.growth = factor
+}
+
+// Grow the array to a new capacity by extending the file and mapping it again.
+// Pointers returned by Get and slices returned by Items before the grow stay
+// valid until the array is closed, as the previous mapping is kept alive.
+// However, they will never see items beyond the capacity they were created with.
+// As the file is extended before the capacity is updated, a grow that is
+// interrupted leaves a larger file, which is truncated when opened again.
+func (arr *Array[T, H]) Grow(capacity int) (err error) {
+	if arr.readonly {
+		return errors.New("array is read-only")
+	}
+
+	if capacity <= arr.head.capacity {
+		return errors.New("capacity must be greater than current capacity")
+	}
+
+	if err = arr.Flush(); err != nil {
+		return
+	}
+
+	head := *arr.head
+	head.capacity = capacity
+
+	if err = arr.file.Truncate(int64(head.fileSize())); err != nil {
+		return
+	}
+
+	data, err := mmap.Map(arr.file, mmap.RDWR, 0)
+
+	if err != nil {
+		return
+	}
+
+	arr.stale = append(arr.stale, arr.data)
+	arr.data = data
+	arr.head = utils.BytesToPointer[header[H]](arr.data[:arr.head.headSize])
+	arr.head.capacity = capacity
+
+	return
+}
+
+func (arr *Array[T, H]) grow() error {
+	if arr.growth <= 1 {
+		return ErrFull
+	}
+
+	factor := arr.growth
+
+	if factor < minGrowth {
+		factor = minGrowth
+	}
+
+	capacity := int(float64(arr.head.capacity) * factor)
+
+	if capacity <= arr.head.capacity {
+		capacity = arr.head.capacity + 1
+	}
+
+	return arr.Grow(capacity)
+}
+
+// Append an item to the end of the array, and return its position. If the
+// array is full and can't grow, -1 is returned.
 func (arr *Array[T, H]) Append(val *T) (pos int) {
+	pos, _ = arr.TryAppend(val)
+	return
+}
+
+// Append an item to the end of the array, and return its position. If the
+// array is full and can't grow, ErrFull or the error of the grow is returned.
+func (arr *Array[T, H]) TryAppend(val *T) (pos int, err error) {
 	if arr.head.length >= arr.head.capacity {
-		return -1
+		if err = arr.grow(); err != nil {
+			return -1, err
+		}
 	}
 
+	// Increase the length first, as positions are wrapped around the length
 	pos = arr.head.length
-	arr.Set(pos, val)
 	arr.head.length++
+	arr.Set(pos, val)
 	return
 }
 
@@ -202,7 +418,7 @@ func (arr *Array[T, H]) ItemSize() int {
 }
 
 func (arr *Array[T, H]) Items() []T {
-	return *utils.BytesToPointer[[]T](arr.data[arr.head.headSize : arr.head.headSize+arr.head.itemSize*arr.head.length])
+	return utils.BytesToSlice[T](arr.data[arr.head.headSize:], arr.head.length)
 }
 
 func (arr Array[T, H]) Head() *H {
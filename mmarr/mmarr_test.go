@@ -0,0 +1,184 @@
+package mmarr
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArrayGrow(t *testing.T) {
+	tests := []struct {
+		name     string
+		factor   float64
+		appends  int
+		wantCap  int
+		wantFull int // Number of appends that fail.
+	}{
+		{"disabled", 0, 6, 4, 2},
+		{"doubled", 2, 9, 16, 0},
+		{"by one", 1.01, 6, 6, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "arr")
+			arr, err := New[uint64](path, 0, 4)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			arr.SetGrowthFactor(tt.factor)
+
+			// Pointers from before a grow stay valid
+			var first *uint64
+			var full int
+
+			for i := 0; i < tt.appends; i++ {
+				v := uint64(i)
+
+				if pos, err := arr.TryAppend(&v); err != nil {
+					if err != ErrFull {
+						t.Fatal(err)
+					}
+
+					full++
+				} else if pos != i {
+					t.Fatalf("expected position %d, got %d", i, pos)
+				}
+
+				if i == 0 {
+					first = arr.Get(0)
+				}
+			}
+
+			if full != tt.wantFull {
+				t.Fatalf("expected %d failed appends, got %d", tt.wantFull, full)
+			}
+
+			if *first != 0 {
+				t.Fatalf("expected 0 through an old pointer, got %d", *first)
+			}
+
+			check := func() {
+				t.Helper()
+
+				if l, c := arr.Len(), arr.Cap(); l != tt.appends-tt.wantFull || c != tt.wantCap {
+					t.Fatalf("expected length %d and capacity %d, got %d and %d", tt.appends-tt.wantFull, tt.wantCap, l, c)
+				}
+
+				for i := 0; i < arr.Len(); i++ {
+					if v := *arr.Get(i); v != uint64(i) {
+						t.Fatalf("expected %d at %d, got %d", i, i, v)
+					}
+				}
+			}
+
+			check()
+
+			if err = arr.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if arr, err = New[uint64](path); err != nil {
+				t.Fatal(err)
+			}
+
+			defer arr.Close()
+
+			check()
+
+			if err = arr.Grow(arr.Cap()); err == nil {
+				t.Fatal("expected error when not growing")
+			}
+		})
+	}
+}
+
+func TestArrayGrowMappings(t *testing.T) {
+	arr, err := New[uint64](filepath.Join(t.TempDir(), "arr"), 0, 4)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer arr.Close()
+
+	arr.SetGrowthFactor(1.01)
+
+	for i := uint64(0); i < 10000; i++ {
+		if arr.Append(&i) < 0 {
+			t.Fatalf("failed to append %d", i)
+		}
+	}
+
+	// Every grow keeps a mapping until the array is closed
+	if n := len(arr.stale); n > 100 {
+		t.Fatalf("expected at most 100 grows, got %d", n)
+	}
+}
+
+func TestArrayInterruptedGrow(t *testing.T) {
+	tests := []struct {
+		name     string
+		open     func(path string) (*Array[uint64, struct{}], error)
+		wantSize bool // Whether the file is truncated back.
+	}{
+		{"writable", func(path string) (*Array[uint64, struct{}], error) { return New[uint64](path) }, true},
+		{"read-only", OpenRO[uint64], false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "arr")
+			arr, err := New[uint64](path, 0, 4)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := uint64(0); i < 2; i++ {
+				arr.Append(&i)
+			}
+
+			size := int64(arr.head.fileSize())
+
+			if err = arr.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The file is extended before the capacity is updated
+			if err = os.Truncate(path, size+4*8); err != nil {
+				t.Fatal(err)
+			}
+
+			if arr, err = tt.open(path); err != nil {
+				t.Fatal(err)
+			}
+
+			if l, c := arr.Len(), arr.Cap(); l != 2 || c != 4 {
+				t.Fatalf("expected length 2 and capacity 4, got %d and %d", l, c)
+			}
+
+			for i := 0; i < 2; i++ {
+				if v := *arr.Get(i); v != uint64(i) {
+					t.Fatalf("expected %d at %d, got %d", i, i, v)
+				}
+			}
+
+			if err = arr.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := os.Stat(path)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (info.Size() == size) != tt.wantSize {
+				t.Fatalf("expected truncated file %v, got size %d", tt.wantSize, info.Size())
+			}
+		})
+	}
+}